@@ -18,35 +18,45 @@ package connector
 
 import (
 	"context"
-	"fmt"
 	"slices"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/chat"
 	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
 	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
 )
 
 var _ bridgev2.BackfillingNetworkAPI = (*BlueskyClient)(nil)
 
 func (b *BlueskyClient) FetchMessages(ctx context.Context, params bridgev2.FetchMessagesParams) (*bridgev2.FetchMessagesResponse, error) {
+	meta := params.Portal.Metadata.(*PortalMetadata)
+	var cursor string
 	if !params.Forward {
-		return nil, fmt.Errorf("backward backfill is not yet supported")
+		cursor = string(params.Cursor)
+		if cursor == "" {
+			cursor = meta.BackfillCursor
+		}
 	}
-	resp, err := chat.ConvoGetMessages(ctx, b.ChatRPC, parsePortalID(params.Portal.ID), "", min(int64(params.Count), 100))
+	resp, err := chat.ConvoGetMessages(ctx, b.ChatRPC, parsePortalID(params.Portal.ID), cursor, min(int64(params.Count), 100))
 	if err != nil {
 		return nil, err
 	}
 	slices.Reverse(resp.Messages)
 	convertedMessages := make([]*bridgev2.BackfillMessage, 0, len(resp.Messages))
 	for _, msg := range resp.Messages {
-		sender, sentAt, msgID, msgData, err := b.parseMessageDetails(msg.ConvoDefs_MessageView, msg.ConvoDefs_DeletedMessageView)
+		sender, sentAt, msgID, rev, msgData, err := b.parseMessageDetails(msg.ConvoDefs_MessageView, msg.ConvoDefs_DeletedMessageView)
 		if err != nil {
 			zerolog.Ctx(ctx).Err(err).Msg("Failed to parse message details")
 			continue
-		} else if params.AnchorMessage != nil && !sentAt.After(params.AnchorMessage.Timestamp) {
+		} else if params.AnchorMessage != nil && params.Forward && !isAfterAnchor(params.AnchorMessage, rev, sentAt) {
+			continue
+		} else if params.AnchorMessage != nil && !params.Forward && !isBeforeAnchor(params.AnchorMessage, rev, sentAt) {
 			continue
 		}
-		data, err := convertMessage(ctx, params.Portal, params.Portal.Bridge.Bot, msgData)
+		data, err := b.convertMessage(ctx, params.Portal, params.Portal.Bridge.Bot, msgData)
 		if err != nil {
 			zerolog.Ctx(ctx).Err(err).Msg("Failed to convert message")
 			continue
@@ -56,9 +66,26 @@ func (b *BlueskyClient) FetchMessages(ctx context.Context, params bridgev2.Fetch
 			Sender:           sender,
 			ID:               makeMessageID(params.Portal.ID, msgID),
 			Timestamp:        sentAt,
-			StreamOrder:      sentAt.UnixMilli(),
+			StreamOrder:      makeStreamOrder(rev, sentAt),
 		})
 	}
+	nextCursor := ptr.Val(resp.Cursor)
+	// The first forward batch in a portal is the newest page, so its cursor is where backward backfill starts.
+	// After that, the cursor is moved back as older pages are fetched.
+	if (!params.Forward || params.AnchorMessage == nil) && meta.BackfillCursor != nextCursor {
+		meta.BackfillCursor = nextCursor
+		err = params.Portal.Save(ctx)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to save backfill cursor")
+		}
+	}
+	if !params.Forward {
+		return &bridgev2.FetchMessagesResponse{
+			Messages: convertedMessages,
+			Cursor:   networkid.PaginationCursor(nextCursor),
+			HasMore:  nextCursor != "",
+		}, nil
+	}
 	chatInfo, ok := params.BundledData.(*chat.ConvoDefs_ConvoView)
 	return &bridgev2.FetchMessagesResponse{
 		Messages: convertedMessages,
@@ -66,3 +93,22 @@ func (b *BlueskyClient) FetchMessages(ctx context.Context, params bridgev2.Fetch
 		MarkRead: ok && chatInfo != nil && chatInfo.UnreadCount == 0,
 	}, nil
 }
+
+// isAfterAnchor checks if a message is newer than the anchor message. Revs are TIDs which sort lexicographically,
+// so they're compared when available, as timestamps may collide.
+func isAfterAnchor(anchor *database.Message, rev string, sentAt time.Time) bool {
+	anchorMeta, ok := anchor.Metadata.(*MessageMetadata)
+	if ok && anchorMeta.Rev != "" && rev != "" {
+		return rev > anchorMeta.Rev
+	}
+	return sentAt.After(anchor.Timestamp)
+}
+
+// isBeforeAnchor is the inverse of isAfterAnchor for backward backfill, i.e. it checks if a message is older than the anchor.
+func isBeforeAnchor(anchor *database.Message, rev string, sentAt time.Time) bool {
+	anchorMeta, ok := anchor.Metadata.(*MessageMetadata)
+	if ok && anchorMeta.Rev != "" && rev != "" {
+		return rev < anchorMeta.Rev
+	}
+	return sentAt.Before(anchor.Timestamp)
+}
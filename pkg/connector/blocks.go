@@ -0,0 +1,102 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+)
+
+type blockState string
+
+const (
+	blockStateNone      blockState = ""
+	blockStateBlocking  blockState = "blocking"
+	blockStateBlockedBy blockState = "blocked_by"
+)
+
+// getBlockState checks if the user has blocked the other member of a DM or vice versa.
+// Groups always return blockStateNone, as blocking a single member doesn't prevent using the group.
+func (b *BlueskyClient) getBlockState(ctx context.Context, convo *chat.ConvoDefs_ConvoView) blockState {
+	if b.isGroupConvo(ctx, convo) {
+		return blockStateNone
+	}
+	for _, member := range convo.Members {
+		if member.Did == b.XRPC.Auth.Did || member.Viewer == nil {
+			continue
+		} else if member.Viewer.Blocking != nil || member.Viewer.BlockingByList != nil {
+			return blockStateBlocking
+		} else if ptr.Val(member.Viewer.BlockedBy) {
+			return blockStateBlockedBy
+		}
+	}
+	return blockStateNone
+}
+
+func sendBlockStateNotice(ctx context.Context, portal *bridgev2.Portal, blocked blockState) {
+	var body string
+	switch blocked {
+	case blockStateBlocking:
+		body = fmt.Sprintf(
+			"You have blocked this user on Bluesky, so messages can't be sent. Use `%s unblock` to unblock them.",
+			portal.Bridge.Config.CommandPrefix,
+		)
+	case blockStateBlockedBy:
+		body = "This user has blocked you on Bluesky, so messages can't be sent."
+	default:
+		body = "This user is no longer blocked, messages can be sent again."
+	}
+	_, err := portal.Bridge.Bot.SendMessage(ctx, portal.MXID, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    body,
+		},
+	}, nil)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("block_state", string(blocked)).Msg("Failed to send block state notice")
+	}
+}
+
+// resyncDMWith queues a resync of the DM with the given user, if there is one, so that changes to the block
+// state are reflected in the portal immediately.
+func (b *BlueskyClient) resyncDMWith(ctx context.Context, did syntax.DID) {
+	resp, err := chat.ConvoGetConvoAvailability(ctx, b.ChatRPC, []string{did.String()})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("did", did).Msg("Failed to find DM to resync")
+		return
+	} else if resp.Convo == nil {
+		return
+	}
+	b.UserLogin.QueueRemoteEvent(&simplevent.ChatResync{
+		EventMeta: simplevent.EventMeta{
+			Type: bridgev2.RemoteEventChatResync,
+			LogContext: func(c zerolog.Context) zerolog.Context {
+				return c.Str("chat_id", resp.Convo.Id).Str("rev", resp.Convo.Rev)
+			},
+			PortalKey: b.portalKeyForConvo(ctx, resp.Convo),
+		},
+		ChatInfo: b.wrapChatInfo(ctx, resp.Convo),
+	})
+}
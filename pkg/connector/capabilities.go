@@ -18,6 +18,7 @@ package connector
 
 import (
 	"context"
+	"strings"
 
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/event"
@@ -33,14 +34,105 @@ func (b *BlueskyConnector) GetCapabilities() *bridgev2.NetworkGeneralCapabilitie
 }
 
 func (b *BlueskyConnector) GetBridgeInfoVersion() (info, capabilities int) {
-	return 1, 1
+	return 1, 2
 }
 
 var roomCaps = &event.RoomFeatures{
-	ID:            "fi.mau.bluesky.capabilities.2025_03_16",
-	MaxTextLength: 10000,
+	ID:            "fi.mau.bluesky.capabilities.2026_10_18.2",
+	MaxTextLength: maxMessageGraphemes,
+	// Reactions and deletions aren't bridged, and are rejected with an error for relayed users too
+	Reaction: event.CapLevelRejected,
+	Delete:   event.CapLevelRejected,
+	// Relayed messages are formatted by the connector using the relay_template config option
+	PerMessageProfileRelay: true,
+}
+
+// roomCapsWithSplitting is used when split_long_messages is enabled,
+// as long messages will be sent as multiple Bluesky messages.
+var roomCapsWithSplitting = &event.RoomFeatures{
+	ID:                     "fi.mau.bluesky.capabilities.2026_10_18.2+split",
+	MaxTextLength:          maxMessageGraphemes * maxMessageSplitParts,
+	Reaction:               event.CapLevelRejected,
+	Delete:                 event.CapLevelRejected,
+	PerMessageProfileRelay: true,
+}
+
+// mediaLinkFeatures describes media sent as public media links, which works for any file type.
+var mediaLinkFeatures = &event.FileFeatures{
+	MimeTypes: map[string]event.CapabilitySupportLevel{
+		"*/*": event.CapLevelPartialSupport,
+	},
+	Caption:          event.CapLevelPartialSupport,
+	MaxCaptionLength: maxMessageGraphemes,
+}
+
+var mediaLinkFileCaps = event.FileFeatureMap{
+	event.MsgImage:      mediaLinkFeatures,
+	event.MsgVideo:      mediaLinkFeatures,
+	event.MsgAudio:      mediaLinkFeatures,
+	event.MsgFile:       mediaLinkFeatures,
+	event.CapMsgVoice:   mediaLinkFeatures,
+	event.CapMsgGIF:     mediaLinkFeatures,
+	event.CapMsgSticker: mediaLinkFeatures,
 }
 
 func (b *BlueskyClient) GetCapabilities(ctx context.Context, portal *bridgev2.Portal) *event.RoomFeatures {
-	return roomCaps
+	caps := roomCaps
+	if b.Main.Config.SplitLongMessages {
+		caps = roomCapsWithSplitting
+	}
+	if b.Main.mediaLinksEnabled() {
+		caps = caps.Clone()
+		caps.ID += "+media_links"
+		caps.File = mediaLinkFileCaps
+	}
+	if b.Main.Config.ReplyQuoteLength > 0 {
+		// Replies are sent as quotes, see makeReplyQuote
+		caps = caps.Clone()
+		caps.ID += "+reply_quotes"
+		caps.Reply = event.CapLevelPartialSupport
+	}
+	caps = b.applyFallbackCaps(caps)
+	if b.Main.Config.EmulatedEdits {
+		// Edits are sent as new messages, see HandleMatrixEdit
+		caps = caps.Clone()
+		caps.ID += "+edits"
+		caps.Edit = event.CapLevelPartialSupport
+	}
+	return caps
+}
+
+var stickerFallbackFeatures = &event.FileFeatures{
+	MimeTypes: map[string]event.CapabilitySupportLevel{
+		"*/*": event.CapLevelPartialSupport,
+	},
+}
+
+// applyFallbackCaps marks message types as supported or rejected based on the message_fallbacks config.
+func (b *BlueskyClient) applyFallbackCaps(caps *event.RoomFeatures) *event.RoomFeatures {
+	fallbacks := &b.Main.Config.Fallbacks
+	caps = caps.Clone()
+	if caps.File == nil {
+		caps.File = make(event.FileFeatureMap)
+	}
+	var enabled []string
+	caps.LocationMessage = event.CapLevelRejected
+	if fallbacks.Locations {
+		enabled = append(enabled, "location")
+		caps.LocationMessage = event.CapLevelPartialSupport
+	}
+	delete(caps.File, event.CapMsgSticker)
+	if fallbacks.Stickers {
+		enabled = append(enabled, "sticker")
+		caps.File[event.CapMsgSticker] = stickerFallbackFeatures
+	}
+	caps.Poll = event.CapLevelRejected
+	if fallbacks.Polls {
+		enabled = append(enabled, "poll")
+		caps.Poll = event.CapLevelPartialSupport
+	}
+	if len(enabled) > 0 {
+		caps.ID += "+fallbacks." + strings.Join(enabled, ".")
+	}
+	return caps
 }
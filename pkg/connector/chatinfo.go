@@ -17,13 +17,15 @@
 package connector
 
 import (
+	"cmp"
 	"context"
 	"fmt"
-	"io"
-	"net/http"
+	"strings"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/ptr"
 	"maunium.net/go/mautrix/bridgev2"
@@ -48,14 +50,19 @@ func (b *BlueskyClient) wrapChatInfo(ctx context.Context, chatInfo *chat.ConvoDe
 			MemberMap:        make(map[networkid.UserID]bridgev2.ChatMember, len(chatInfo.Members)),
 		},
 		UserLocal:   &bridgev2.UserLocalPortalInfo{},
-		CanBackfill: false, // Backward backfill isn't supported yet
+		CanBackfill: true,
 	}
 	if chatInfo.Muted {
 		info.UserLocal.MutedUntil = &event.MutedForever
 	}
-	if len(chatInfo.Members) == 2 {
+	isGroup := b.isGroupConvo(ctx, chatInfo)
+	if isGroup {
+		info.Type = ptr.Ptr(database.RoomTypeGroupDM)
+	} else {
 		info.Type = ptr.Ptr(database.RoomTypeDM)
 	}
+	var memberNames []string
+	var groupAvatar string
 	for _, member := range chatInfo.Members {
 		evtSender, err := b.makeEventSender(member.Did)
 		if err != nil {
@@ -63,54 +70,230 @@ func (b *BlueskyClient) wrapChatInfo(ctx context.Context, chatInfo *chat.ConvoDe
 			info.Members.IsFull = false
 			continue
 		}
+		profile := b.Main.Profiles.getCached(member.Did)
+		if profile == nil {
+			profile = &bsky.ActorDefs_ProfileViewDetailed{
+				Did:          member.Did,
+				Handle:       member.Handle,
+				DisplayName:  member.DisplayName,
+				Avatar:       member.Avatar,
+				Verification: member.Verification,
+			}
+		}
+		handle := b.verifyHandle(ctx, profile.Did, profile.Handle)
 		info.Members.MemberMap[evtSender.Sender] = bridgev2.ChatMember{
 			EventSender: evtSender,
-			UserInfo: &bridgev2.UserInfo{
-				Identifiers: []string{member.Did, fmt.Sprintf("bluesky:%s", member.Handle)},
-				Name:        ptr.Ptr(b.Main.Config.FormatDisplayname(ptr.Val(member.DisplayName), member.Handle, member.Did)),
-				Avatar:      b.wrapAvatar(ptr.Val(member.Avatar)),
-			},
+			Membership:  event.MembershipJoin,
+			UserInfo:    b.wrapProfile(profile, handle, false),
+		}
+		if !evtSender.IsFromMe {
+			memberNames = append(memberNames, cmp.Or(ptr.Val(profile.DisplayName), handle))
+			if groupAvatar == "" {
+				groupAvatar = ptr.Val(profile.Avatar)
+			}
 		}
 	}
+	blocked := b.getBlockState(ctx, chatInfo)
+	if isGroup {
+		// Bluesky doesn't have group names or avatars, so derive them from the other members
+		info.Name = ptr.Ptr(strings.Join(memberNames, ", "))
+		info.Avatar = b.wrapAvatar(groupAvatar)
+	} else {
+		// Blocked DMs can't be written to, so make the room read-only until the block is removed
+		eventsDefault := 0
+		if blocked != blockStateNone {
+			eventsDefault = 100
+		}
+		info.Members.PowerLevels = &bridgev2.PowerLevelOverrides{EventsDefault: &eventsDefault}
+	}
+	info.ExtraUpdates = updatePortalMetadata(chatInfo, blocked)
 	return info
 }
 
+// isGroupConvo checks if a convo should be bridged as a group. Bluesky doesn't have any group metadata,
+// so groups are convos with more than two members. Convos that have already been bridged as shared
+// group portals stay groups even if members leave, so that the portal key doesn't change.
+//
+// The result is cached until membership changes, see HandleMemberChange.
+func (b *BlueskyClient) isGroupConvo(ctx context.Context, convo *chat.ConvoDefs_ConvoView) bool {
+	if isGroup, ok := b.groupConvos.Get(convo.Id); ok {
+		return isGroup
+	}
+	isGroup := len(convo.Members) > 2 || b.hasSharedPortal(ctx, convo.Id)
+	b.groupConvos.Set(convo.Id, isGroup)
+	return isGroup
+}
+
+func (b *BlueskyClient) hasSharedPortal(ctx context.Context, convoID string) bool {
+	if b.Main.Bridge.Config.SplitPortals {
+		return false
+	}
+	portal, err := b.Main.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: makePortalID(convoID)})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("chat_id", convoID).Msg("Failed to check for shared portal")
+		return false
+	}
+	return portal != nil
+}
+
+func (b *BlueskyClient) portalKeyForConvo(ctx context.Context, convo *chat.ConvoDefs_ConvoView) networkid.PortalKey {
+	return b.makePortalKey(convo.Id, b.isGroupConvo(ctx, convo))
+}
+
+// getPortalKey finds the portal key for a convo ID, fetching the convo info if it's not cached yet.
+func (b *BlueskyClient) getPortalKey(ctx context.Context, convoID string) (key networkid.PortalKey, isGroup bool) {
+	isGroup, ok := b.groupConvos.Get(convoID)
+	if !ok {
+		resp, err := chat.ConvoGetConvo(ctx, b.ChatRPC, convoID)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("chat_id", convoID).Msg("Failed to get convo info to determine portal key")
+			isGroup = b.hasSharedPortal(ctx, convoID)
+		} else {
+			isGroup = b.isGroupConvo(ctx, resp.Convo)
+		}
+	}
+	return b.makePortalKey(convoID, isGroup), isGroup
+}
+
 func (b *BlueskyClient) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*bridgev2.UserInfo, error) {
 	actorID := string(parseUserID(ghost.ID))
 	if actorID == "" {
 		return nil, fmt.Errorf("failed to parse ghost ID")
 	}
-	profile, err := bsky.ActorGetProfile(ctx, b.XRPC, actorID)
+	if lastFetch := ghost.Metadata.(*GhostMetadata).LastProfileFetch; ghost.Name != "" && time.Since(lastFetch.Time) < profileCacheTTL {
+		// Names and avatars are also updated from chat info, so full profiles don't need to be refetched often
+		return nil, nil
+	}
+	profile, err := b.Main.Profiles.Get(ctx, b.AppView, actorID)
 	if err != nil {
 		return nil, err
 	}
+	return b.wrapProfile(profile, b.verifyHandle(ctx, profile.Did, profile.Handle), true), nil
+}
+
+type profileVerification struct {
+	VerifiedStatus        string   `json:"verified_status,omitempty"`
+	TrustedVerifierStatus string   `json:"trusted_verifier_status,omitempty"`
+	Verifiers             []string `json:"verifiers,omitempty"`
+}
+
+type pronounsEntry struct {
+	Language string `json:"language"`
+	Summary  string `json:"summary"`
+}
+
+// wrapProfile converts a profile into ghost info. The handle must already be verified with verifyHandle.
+//
+// Ghosts are shared by all logins, so anything that depends on the viewer (e.g. follow status) must not be included.
+// The relationship with a user can be checked with the whois command instead.
+func (b *BlueskyClient) wrapProfile(profile *bsky.ActorDefs_ProfileViewDetailed, handle string, fullProfile bool) *bridgev2.UserInfo {
+	params := &DisplaynameParams{
+		DisplayName: ptr.Val(profile.DisplayName),
+		Handle:      handle,
+		DID:         profile.Did,
+		Description: ptr.Val(profile.Description),
+		Pronouns:    ptr.Val(profile.Pronouns),
+		Website:     ptr.Val(profile.Website),
+	}
+	var extra database.ExtraProfile
+	if params.Description != "" {
+		extra.With("fi.mau.bluesky.description", params.Description)
+	}
+	if params.Pronouns != "" {
+		extra.With("io.fsn.msc4247.pronouns", []pronounsEntry{{Language: "en", Summary: params.Pronouns}})
+	}
+	if params.Website != "" {
+		extra.With("fi.mau.bluesky.website", params.Website)
+	}
+	if profile.Banner != nil {
+		extra.With("fi.mau.bluesky.banner", *profile.Banner)
+	}
+	if profile.Verification != nil {
+		params.Verified = profile.Verification.VerifiedStatus == "valid"
+		params.TrustedVerifier = profile.Verification.TrustedVerifierStatus == "valid"
+		verification := profileVerification{
+			VerifiedStatus:        profile.Verification.VerifiedStatus,
+			TrustedVerifierStatus: profile.Verification.TrustedVerifierStatus,
+		}
+		for _, verif := range profile.Verification.Verifications {
+			if verif.IsValid {
+				verification.Verifiers = append(verification.Verifiers, verif.Issuer)
+			}
+		}
+		extra.With("fi.mau.bluesky.verification", &verification)
+	}
 	return &bridgev2.UserInfo{
-		Identifiers: []string{profile.Did, fmt.Sprintf("bluesky:%s", profile.Handle)},
-		Name:        ptr.Ptr(b.Main.Config.FormatDisplayname(ptr.Val(profile.DisplayName), profile.Handle, profile.Did)),
-		Avatar:      b.wrapAvatar(ptr.Val(profile.Avatar)),
-	}, nil
+		Identifiers:  makeIdentifiers(profile.Did, params.Handle),
+		Name:         ptr.Ptr(b.Main.Config.FormatDisplayname(params)),
+		Avatar:       b.wrapAvatar(ptr.Val(profile.Avatar)),
+		ExtraProfile: extra,
+		ExtraUpdates: updateGhostMetadata(params.Handle, fullProfile),
+	}
+}
+
+func makeIdentifiers(did, handle string) []string {
+	if handle == syntax.HandleInvalid.String() {
+		return []string{did}
+	}
+	return []string{did, fmt.Sprintf("bluesky:%s", handle)}
+}
+
+// verifyHandle checks that the handle claimed for a DID is bidirectionally valid, i.e. the DID document
+// lists the handle and the handle resolves back to the DID. If it isn't, `handle.invalid` is returned
+// like in the official Bluesky clients.
+func (b *BlueskyClient) verifyHandle(ctx context.Context, did, claimedHandle string) string {
+	parsedDID, err := syntax.ParseDID(did)
+	if err != nil {
+		return syntax.HandleInvalid.String()
+	}
+	ident, err := b.Main.Directory.LookupDID(ctx, parsedDID)
+	if err == nil && !ident.Handle.IsInvalidHandle() && ident.Handle.String() != strings.ToLower(claimedHandle) &&
+		claimedHandle != syntax.HandleInvalid.String() && b.Main.shouldRefreshIdentity(parsedDID) {
+		// The handle may have changed after the identity was cached, so purge the cache and try again
+		err = b.Main.Directory.Purge(ctx, parsedDID.AtIdentifier())
+		if err == nil {
+			ident, err = b.Main.Directory.LookupDID(ctx, parsedDID)
+		}
+	}
+	if err != nil {
+		// Don't mark everyone as invalid if the lookup fails for other reasons,
+		// the AppView will also return handle.invalid if it knows the handle is invalid.
+		zerolog.Ctx(ctx).Warn().Err(err).Str("did", did).Msg("Failed to verify handle")
+		return claimedHandle
+	}
+	return ident.Handle.String()
 }
 
 func (b *BlueskyClient) wrapAvatar(url string) *bridgev2.Avatar {
 	return &bridgev2.Avatar{
 		ID: networkid.AvatarID(url),
 		Get: func(ctx context.Context) ([]byte, error) {
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-			if err != nil {
-				return nil, fmt.Errorf("failed to prepare request: %w", err)
-			}
-			req.Header.Set("User-Agent", *b.XRPC.UserAgent)
-			resp, err := b.XRPC.Client.Do(req)
-			if err != nil {
-				return nil, fmt.Errorf("failed to send request: %w", err)
-			}
-			data, err := io.ReadAll(resp.Body)
-			_ = resp.Body.Close()
+			media, err := b.Main.Media.Fetch(ctx, &MediaRequest{
+				URL:             url,
+				AllowedTypes:    []string{"image/"},
+				PreferThumbnail: true,
+			})
 			if err != nil {
-				return nil, fmt.Errorf("failed to read response: %w", err)
+				return nil, fmt.Errorf("failed to download avatar: %w", err)
 			}
-			return data, nil
+			return media.Data, nil
 		},
 		Remove: url == "",
 	}
 }
+
+// identityFreshness is the minimum time between purging the cached identity of a DID when the handle
+// claimed by the AppView doesn't match the cached one.
+const identityFreshness = 10 * time.Minute
+
+// shouldRefreshIdentity checks if the cached identity of the given DID may be purged, i.e. it hasn't been
+// refreshed within identityFreshness. If it returns true, the DID is marked as refreshed.
+func (b *BlueskyConnector) shouldRefreshIdentity(did syntax.DID) bool {
+	b.identityRefreshLock.Lock()
+	defer b.identityRefreshLock.Unlock()
+	if time.Since(b.identityRefreshes[did]) < identityFreshness {
+		return false
+	}
+	b.identityRefreshes[did] = time.Now()
+	return true
+}
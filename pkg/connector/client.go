@@ -17,47 +17,116 @@
 package connector
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/bluesky-social/indigo/atproto/auth/oauth"
 	"github.com/bluesky-social/indigo/atproto/syntax"
-	"github.com/bluesky-social/indigo/util"
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/rs/zerolog"
-	"maunium.net/go/mautrix"
+	"go.mau.fi/util/exsync"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/bridgev2/simplevent"
 	"maunium.net/go/mautrix/bridgev2/status"
 )
 
+func proxyHeaders(service string) map[string]string {
+	if service == "" {
+		return nil
+	}
+	return map[string]string{
+		"Atproto-Proxy": service,
+	}
+}
+
+// getServices returns the chat and AppView services to proxy requests to for a login,
+// which are the per-login overrides if set and the config options otherwise.
+func (b *BlueskyConnector) getServices(meta *UserLoginMetadata) (chatService, appViewService string, err error) {
+	chatService = cmp.Or(meta.ChatService, b.Config.ChatService)
+	appViewService = cmp.Or(meta.AppViewService, b.Config.AppViewService)
+	if err = validateServiceRef(chatService); err != nil {
+		return "", "", fmt.Errorf("invalid chat service override: %w", err)
+	} else if appViewService != "" {
+		if err = validateServiceRef(appViewService); err != nil {
+			return "", "", fmt.Errorf("invalid AppView service override: %w", err)
+		}
+	}
+	return
+}
+
 func (b *BlueskyConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserLogin) error {
 	meta := login.Metadata.(*UserLoginMetadata)
+	chatService, appViewService, err := b.getServices(meta)
+	if err != nil {
+		return err
+	}
+	httpClient := b.HTTPClient
 	x := &xrpc.Client{
-		Client:    util.RobustHTTPClient(),
+		Client:    httpClient,
 		Host:      meta.Host,
 		Auth:      meta.Auth,
-		UserAgent: &mautrix.DefaultUserAgent,
+		UserAgent: &b.UserAgent,
+	}
+	var oauthSess *oauth.ClientSession
+	var oauthUnavailable bool
+	if meta.OAuth != nil && b.OAuth == nil {
+		// Don't fail loading entirely, so the login is still listed and the user is told to fix the config or relogin
+		login.Log.Warn().Msg("Login uses OAuth, but OAuth is disabled because the bridge public address isn't configured")
+		oauthUnavailable = true
+	} else if meta.OAuth != nil {
+		oauthSess, err = b.newOAuthSession(meta.OAuth, func(ctx context.Context, data *oauth.ClientSessionData) {
+			err := login.Save(ctx)
+			if err != nil {
+				zerolog.Ctx(ctx).Err(err).Msg("Failed to save updated OAuth session")
+			}
+		})
+		if err != nil {
+			return err
+		}
+		x.Client = &http.Client{Transport: &oauthTransport{Session: oauthSess, Client: httpClient}}
 	}
 	chatX := &xrpc.Client{
 		Client:    x.Client,
 		Host:      x.Host,
 		Auth:      x.Auth,
 		UserAgent: x.UserAgent,
-		Headers: map[string]string{
-			"Atproto-Proxy": "did:web:api.bsky.chat#bsky_chat",
-		},
+		Headers:   proxyHeaders(chatService),
+	}
+	appViewX := &xrpc.Client{
+		Client:    x.Client,
+		Host:      x.Host,
+		Auth:      x.Auth,
+		UserAgent: x.UserAgent,
+		Headers:   proxyHeaders(appViewService),
+	}
+	moderationX := &xrpc.Client{
+		Client:    x.Client,
+		Host:      x.Host,
+		Auth:      x.Auth,
+		UserAgent: x.UserAgent,
+		Headers:   proxyHeaders(b.Config.ModerationService),
 	}
 	login.Client = &BlueskyClient{
-		UserLogin: login,
-		Main:      b,
-		XRPC:      x,
-		ChatRPC:   chatX,
+		UserLogin:  login,
+		Main:       b,
+		XRPC:       x,
+		ChatRPC:    chatX,
+		AppView:    appViewX,
+		Moderation: moderationX,
+		OAuth:      oauthSess,
+		HTTP:       httpClient,
+
+		oauthUnavailable: oauthUnavailable,
+		groupConvos:      exsync.NewMap[string, bool](),
 	}
 	return nil
 }
@@ -67,68 +136,146 @@ type BlueskyClient struct {
 	Main      *BlueskyConnector
 	XRPC      *xrpc.Client
 	ChatRPC   *xrpc.Client
+	// AppView is the same as XRPC, except proxied to the configured AppView if there is one
+	AppView *xrpc.Client
+	// Moderation is the same as XRPC, except proxied to the configured moderation service
+	Moderation *xrpc.Client
+	// OAuth is only set for logins made using the OAuth flow
+	OAuth *oauth.ClientSession
+	// HTTP is the plain HTTP client without any authentication
+	HTTP *http.Client
 
 	stopPolling atomic.Pointer[context.CancelFunc]
+	// oauthUnavailable is set for OAuth logins loaded while OAuth is disabled in the bridge
+	oauthUnavailable bool
+	// groupConvos caches whether convos are bridged as groups, see isGroupConvo
+	groupConvos *exsync.Map[string, bool]
 }
 
 var _ bridgev2.NetworkAPI = (*BlueskyClient)(nil)
 
 func (b *BlueskyClient) Connect(ctx context.Context) {
+	if b.oauthUnavailable {
+		b.UserLogin.BridgeState.Send(status.BridgeState{
+			StateEvent: status.StateBadCredentials,
+			Error:      "bsky-oauth-unavailable",
+		})
+		return
+	}
 	b.UserLogin.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting})
 	err := b.refreshToken(ctx)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to refresh token")
-		b.UserLogin.BridgeState.Send(status.BridgeState{
-			StateEvent: status.StateUnknownError,
-			Error:      "bsky-token-refresh-failed",
-		})
+		b.sendTokenRefreshFailedState(err)
 		return
 	}
 	err = b.fetchInbox(ctx)
-	if err != nil {
+	if isChatAccessDenied(err) {
+		zerolog.Ctx(ctx).Err(err).Msg("Session doesn't have access to chats")
+		b.sendNoChatAccessState()
+		return
+	} else if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to fetch inbox during startup")
 	}
 	go b.startPolling()
 }
 
-func (b *BlueskyClient) refreshToken(ctx context.Context) error {
-	// The client is dumb and doesn't know how to use the refresh token itself,
-	// so make a new client that has the refresh token in the access token slot.
-	refreshClient := &xrpc.Client{
-		Client: b.XRPC.Client,
-		Auth: &xrpc.AuthInfo{
-			AccessJwt:  b.XRPC.Auth.RefreshJwt,
-			RefreshJwt: b.XRPC.Auth.RefreshJwt,
-			Handle:     b.XRPC.Auth.Handle,
-			Did:        b.XRPC.Auth.Did,
-		},
-		Host:      b.XRPC.Host,
-		UserAgent: b.XRPC.UserAgent,
-		Headers:   b.XRPC.Headers,
-	}
-	resp, err := atproto.ServerRefreshSession(ctx, refreshClient)
-	if err != nil {
-		return err
+// isSessionExpired checks if a token refresh error means that the refresh token is no longer valid,
+// in which case retrying won't help and the user needs to log in again.
+func isSessionExpired(err error) bool {
+	if err == nil {
+		return false
+	}
+	// The OAuth client doesn't return typed errors, but includes the OAuth error code in the message
+	return isXRPCError(err, "ExpiredToken") || isXRPCError(err, "InvalidToken") ||
+		strings.Contains(err.Error(), "invalid_grant")
+}
+
+func (b *BlueskyClient) sendTokenRefreshFailedState(err error) {
+	if isSessionExpired(err) {
+		b.UserLogin.BridgeState.Send(status.BridgeState{
+			StateEvent: status.StateBadCredentials,
+			Error:      "bsky-session-expired",
+			Message: fmt.Sprintf(
+				"Your Bluesky session has expired. Use `%s relogin %s` to log in again, existing chats will be kept.",
+				b.Main.Bridge.Config.CommandPrefix, b.UserLogin.ID,
+			),
+			UserAction: status.UserActionRelogin,
+		})
+	} else {
+		b.UserLogin.BridgeState.Send(status.BridgeState{
+			StateEvent: status.StateUnknownError,
+			Error:      "bsky-token-refresh-failed",
+		})
 	}
-	// TODO check account status in response
+}
+
+func (b *BlueskyClient) sendNoChatAccessState() {
+	b.UserLogin.BridgeState.Send(status.BridgeState{
+		StateEvent: status.StateBadCredentials,
+		Error:      "bsky-no-chat-access",
+		UserAction: status.UserActionRelogin,
+	})
+}
+
+func (b *BlueskyClient) refreshToken(ctx context.Context) error {
 	meta := b.UserLogin.Metadata.(*UserLoginMetadata)
-	if resp.Did != meta.Auth.Did {
-		return fmt.Errorf("DID changed from %s to %s", meta.Auth.Did, resp.Did)
+	var did, handle string
+	var didDoc *any
+	var refreshed *atproto.ServerRefreshSession_Output
+	if b.OAuth != nil {
+		// The persist callback will save the new tokens
+		_, err := b.OAuth.RefreshTokens(ctx)
+		if err != nil {
+			return err
+		}
+		// OAuth token responses don't include the account info, so fetch it separately
+		resp, err := atproto.ServerGetSession(ctx, b.XRPC)
+		if err != nil {
+			return fmt.Errorf("failed to get session info: %w", err)
+		}
+		did, handle, didDoc = resp.Did, resp.Handle, resp.DidDoc
+	} else {
+		// The client is dumb and doesn't know how to use the refresh token itself,
+		// so make a new client that has the refresh token in the access token slot.
+		refreshClient := &xrpc.Client{
+			Client: b.XRPC.Client,
+			Auth: &xrpc.AuthInfo{
+				AccessJwt:  b.XRPC.Auth.RefreshJwt,
+				RefreshJwt: b.XRPC.Auth.RefreshJwt,
+				Handle:     b.XRPC.Auth.Handle,
+				Did:        b.XRPC.Auth.Did,
+			},
+			Host:      b.XRPC.Host,
+			UserAgent: b.XRPC.UserAgent,
+		}
+		resp, err := atproto.ServerRefreshSession(ctx, refreshClient)
+		if err != nil {
+			return err
+		}
+		// TODO check account status in response
+		refreshed = resp
+		did, handle, didDoc = resp.Did, resp.Handle, resp.DidDoc
+	}
+	if did != meta.Auth.Did {
+		return fmt.Errorf("DID changed from %s to %s", meta.Auth.Did, did)
+	}
+	if refreshed != nil {
+		meta.Auth.RefreshJwt = refreshed.RefreshJwt
+		meta.Auth.AccessJwt = refreshed.AccessJwt
 	}
-	meta.Auth.RefreshJwt = resp.RefreshJwt
-	meta.Auth.AccessJwt = resp.AccessJwt
 	log := zerolog.Ctx(ctx)
-	if resp.Handle != meta.Auth.Handle {
+	if handle != meta.Auth.Handle {
 		log.Debug().
 			Str("old_handle", meta.Auth.Handle).
-			Str("new_handle", resp.Handle).
+			Str("new_handle", handle).
 			Msg("Handle changed")
-		meta.Auth.Handle = resp.Handle
-		b.UserLogin.RemoteName = resp.Handle
-		b.UserLogin.RemoteProfile.Username = resp.Handle
+		meta.Auth.Handle = handle
+		b.UserLogin.RemoteName = handle
+		b.UserLogin.RemoteProfile.Username = handle
 	}
-	if resp.DidDoc != nil {
-		ident, err := parseDIDDoc(resp.DidDoc)
+	if didDoc != nil {
+		ident, err := parseDIDDoc(didDoc)
 		if err != nil {
 			log.Warn().Err(err).Msg("Failed to parse DID doc")
 		} else if ident != nil {
@@ -139,12 +286,17 @@ func (b *BlueskyClient) refreshToken(ctx context.Context) error {
 					Str("new_pds", pdsEndpoint).
 					Msg("PDS endpoint changed")
 				meta.Host = pdsEndpoint
+				if meta.OAuth != nil {
+					meta.OAuth.HostURL = pdsEndpoint
+				}
 				b.XRPC.Host = pdsEndpoint
 				b.ChatRPC.Host = pdsEndpoint
+				b.AppView.Host = pdsEndpoint
+				b.Moderation.Host = pdsEndpoint
 			}
 		}
 	}
-	err = b.UserLogin.Save(ctx)
+	err := b.UserLogin.Save(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to save refreshed login: %w", err)
 	}
@@ -153,8 +305,16 @@ func (b *BlueskyClient) refreshToken(ctx context.Context) error {
 
 const PollInterval = 5 * time.Second
 
+// InboxRefreshInterval is how often the convo list is refetched while polling. Blocks don't appear in the
+// convo log, so this is how block state changes made outside the bridge reach DM portals.
+const InboxRefreshInterval = 5 * time.Minute
+
 func (b *BlueskyClient) nextAccessTokenExpiry() time.Time {
-	parsedJWT, err := jwt.Parse([]byte(b.XRPC.Auth.AccessJwt), jwt.WithVerify(false))
+	accessToken := b.XRPC.Auth.AccessJwt
+	if b.OAuth != nil {
+		accessToken, _ = b.OAuth.GetHostAccessData()
+	}
+	parsedJWT, err := jwt.Parse([]byte(accessToken), jwt.WithVerify(false))
 	if err != nil {
 		return time.Now().Add(10 * time.Minute)
 	}
@@ -168,7 +328,25 @@ func (b *BlueskyClient) fetchInbox(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	changedConvos := make([]*chat.ConvoDefs_ConvoView, 0, len(chats.Convos))
 	for _, chatInfo := range chats.Convos {
+		portal, err := b.Main.Bridge.GetExistingPortalByKey(ctx, b.portalKeyForConvo(ctx, chatInfo))
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Str("chat_id", chatInfo.Id).Msg("Failed to get portal to check for changes")
+			continue
+		} else if portal != nil && portal.MXID != "" && portal.Metadata.(*PortalMetadata).Rev == chatInfo.Rev &&
+			portal.Metadata.(*PortalMetadata).BlockState == b.getBlockState(ctx, chatInfo) {
+			// Blocks don't change the convo rev, so the block state is checked separately
+			continue
+		}
+		changedConvos = append(changedConvos, chatInfo)
+	}
+	zerolog.Ctx(ctx).Debug().
+		Int("total_convos", len(chats.Convos)).
+		Int("changed_convos", len(changedConvos)).
+		Msg("Fetched inbox")
+	b.prefetchMemberProfiles(ctx, changedConvos)
+	for _, chatInfo := range changedConvos {
 		var latestMessageTS time.Time
 		if chatInfo.LastMessage != nil {
 			if chatInfo.LastMessage.ConvoDefs_MessageView != nil {
@@ -181,9 +359,9 @@ func (b *BlueskyClient) fetchInbox(ctx context.Context) error {
 			EventMeta: simplevent.EventMeta{
 				Type: bridgev2.RemoteEventChatResync,
 				LogContext: func(c zerolog.Context) zerolog.Context {
-					return c.Str("chat_id", chatInfo.Id)
+					return c.Str("chat_id", chatInfo.Id).Str("rev", chatInfo.Rev)
 				},
-				PortalKey:    b.makePortalKey(chatInfo.Id),
+				PortalKey:    b.portalKeyForConvo(ctx, chatInfo),
 				CreatePortal: true,
 			},
 			ChatInfo:            b.wrapChatInfo(ctx, chatInfo),
@@ -194,6 +372,23 @@ func (b *BlueskyClient) fetchInbox(ctx context.Context) error {
 	return nil
 }
 
+// prefetchMemberProfiles fills the profile cache with everyone in the given chats,
+// so that ghost info updates don't need to fetch each profile separately.
+func (b *BlueskyClient) prefetchMemberProfiles(ctx context.Context, convos []*chat.ConvoDefs_ConvoView) {
+	var dids []string
+	for _, convo := range convos {
+		for _, member := range convo.Members {
+			if member.Did != b.XRPC.Auth.Did {
+				dids = append(dids, member.Did)
+			}
+		}
+	}
+	err := b.Main.Profiles.Prefetch(ctx, b.AppView, dids)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to prefetch chat member profiles")
+	}
+}
+
 func (b *BlueskyClient) startPolling() {
 	ctx, cancel := context.WithCancel(context.Background())
 	oldCancel := b.stopPolling.Swap(&cancel)
@@ -204,16 +399,22 @@ func (b *BlueskyClient) startPolling() {
 	ctx = log.WithContext(ctx)
 	log.Info().Time("next_token_expiry", b.nextAccessTokenExpiry()).Msg("Starting polling")
 	ticker := time.NewTicker(PollInterval)
+	inboxTicker := time.NewTicker(InboxRefreshInterval)
 	expiryTimer := time.NewTimer(time.Until(b.nextAccessTokenExpiry()) - 2*time.Minute)
 	defer func() {
 		ticker.Stop()
+		inboxTicker.Stop()
 		log.Debug().Msg("Stopped polling")
 	}()
 	ctxDone := ctx.Done()
 	isErroring := true
 	for {
 		err := b.pollOnce(ctx)
-		if err != nil {
+		if isChatAccessDenied(err) {
+			log.Err(err).Msg("Lost access to chats")
+			b.sendNoChatAccessState()
+			return
+		} else if err != nil {
 			isErroring = true
 			log.Err(err).Msg("Failed to poll for messages")
 			b.UserLogin.BridgeState.Send(status.BridgeState{
@@ -227,15 +428,21 @@ func (b *BlueskyClient) startPolling() {
 		}
 		select {
 		case <-ticker.C:
+		case <-inboxTicker.C:
+			err = b.fetchInbox(ctx)
+			if err != nil {
+				log.Err(err).Msg("Failed to refresh inbox")
+			}
 		case <-expiryTimer.C:
 			err = b.refreshToken(ctx)
-			if err != nil {
+			if isSessionExpired(err) {
+				log.Err(err).Msg("Session expired, stopping polling")
+				b.sendTokenRefreshFailedState(err)
+				return
+			} else if err != nil {
 				log.Err(err).Msg("Failed to refresh token")
 				expiryTimer.Reset(30 * time.Second)
-				b.UserLogin.BridgeState.Send(status.BridgeState{
-					StateEvent: status.StateUnknownError,
-					Error:      "bsky-token-refresh-failed",
-				})
+				b.sendTokenRefreshFailedState(err)
 			} else {
 				nextExpiry := b.nextAccessTokenExpiry()
 				log.Debug().Time("next_expiry", nextExpiry).Msg("Refreshed token")
@@ -276,11 +483,16 @@ func (b *BlueskyClient) Disconnect() {
 }
 
 func (b *BlueskyClient) IsLoggedIn() bool {
-	return b.XRPC.Auth != nil
+	return b.XRPC.Auth != nil && !b.oauthUnavailable
 }
 
 func (b *BlueskyClient) LogoutRemote(ctx context.Context) {
-	if b.XRPC.Auth != nil {
+	if b.OAuth != nil {
+		err := b.OAuth.RevokeSession(ctx)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to revoke OAuth session")
+		}
+	} else if b.XRPC.Auth != nil {
 		err := atproto.ServerDeleteSession(ctx, b.XRPC)
 		if err != nil {
 			zerolog.Ctx(ctx).Err(err).Msg("Failed to delete session")
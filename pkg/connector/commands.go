@@ -0,0 +1,398 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/format"
+)
+
+var HelpSectionBluesky = commands.HelpSection{Name: "Bluesky", Order: 25}
+
+func (b *BlueskyConnector) registerCommands() {
+	proc, ok := b.Bridge.Commands.(*commands.Processor)
+	if !ok {
+		return
+	}
+	proc.AddHandlers(
+		cmdWhois,
+		cmdFollow,
+		cmdUnfollow,
+		cmdBlock,
+		cmdUnblock,
+		cmdMute,
+		cmdUnmute,
+		cmdResync,
+		cmdReport,
+		cmdSetService,
+	)
+}
+
+var cmdWhois = &commands.FullHandler{
+	Func: fnWhois,
+	Name: "whois",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionBluesky,
+		Description: "View the profile of a Bluesky user",
+		Args:        "[_handle or DID_]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdFollow = makeGraphCommand("follow", "Follow a Bluesky user", "Followed", (*BlueskyClient).follow)
+var cmdUnfollow = makeGraphCommand("unfollow", "Unfollow a Bluesky user", "Unfollowed", (*BlueskyClient).unfollow)
+var cmdBlock = makeGraphCommand("block", "Block a Bluesky user", "Blocked", (*BlueskyClient).block)
+var cmdUnblock = makeGraphCommand("unblock", "Unblock a Bluesky user", "Unblocked", (*BlueskyClient).unblock)
+var cmdMute = makeGraphCommand("mute", "Mute a Bluesky user", "Muted", func(b *BlueskyClient, ctx context.Context, did syntax.DID) error {
+	return b.setMuted(ctx, did, true)
+})
+var cmdUnmute = makeGraphCommand("unmute", "Unmute a Bluesky user", "Unmuted", func(b *BlueskyClient, ctx context.Context, did syntax.DID) error {
+	return b.setMuted(ctx, did, false)
+})
+
+var cmdResync = &commands.FullHandler{
+	Func: fnResync,
+	Name: "resync",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionBluesky,
+		Description: "Resync the info and members of the current chat from Bluesky",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+var cmdReport = &commands.FullHandler{
+	Func: fnReport,
+	Name: "report",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionBluesky,
+		Description: "Report the replied-to message, or the other user in a DM, to Bluesky moderation",
+		Args:        "<spam/violation/misleading/sexual/rude/other> [_comment_]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+var cmdSetService = &commands.FullHandler{
+	Func: fnSetService,
+	Name: "set-service",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionBluesky,
+		Description: "View or override the chat or AppView service used by your login, e.g. `did:web:api.bsky.chat#bsky_chat`",
+		Args:        "<chat/appview> [_service or `default`_]",
+	},
+	RequiresLogin: true,
+}
+
+// getCommandClient finds the login to use for a command, preferring the one in the current portal if there is one.
+func getCommandClient(ce *commands.Event) *BlueskyClient {
+	var login *bridgev2.UserLogin
+	if ce.Portal != nil {
+		login, _, _ = ce.Portal.FindPreferredLogin(ce.Ctx, ce.User, false)
+	}
+	if login == nil {
+		login = ce.User.GetDefaultLogin()
+	}
+	if login == nil {
+		ce.Reply("You're not logged in")
+		return nil
+	}
+	client, ok := login.Client.(*BlueskyClient)
+	if !ok || !client.IsLoggedIn() {
+		ce.Reply("Your Bluesky login (%s) isn't connected", format.SafeMarkdownCode(login.RemoteName))
+		return nil
+	}
+	return client
+}
+
+// resolveCommandTarget resolves the user given as a command argument. If there are no arguments
+// and the command is used in a DM portal, the other user in the DM is used.
+func resolveCommandTarget(ce *commands.Event, client *BlueskyClient) *identity.Identity {
+	var rawTarget string
+	if len(ce.Args) > 0 {
+		rawTarget = strings.TrimPrefix(ce.Args[0], "@")
+	} else if ce.Portal != nil && ce.Portal.OtherUserID != "" {
+		rawTarget = parseUserID(ce.Portal.OtherUserID).String()
+	} else {
+		ce.Reply("**Usage:** `$cmdprefix %s <handle or DID>`", ce.Command)
+		return nil
+	}
+	atID, err := syntax.ParseAtIdentifier(rawTarget)
+	if err != nil {
+		ce.Reply("%s is not a valid handle or DID", format.SafeMarkdownCode(rawTarget))
+		return nil
+	}
+	ident, err := client.Main.Directory.Lookup(ce.Ctx, atID)
+	if err != nil {
+		ce.Log.Debug().Err(err).Str("target", rawTarget).Msg("Failed to resolve command target")
+		ce.Reply("Failed to resolve %s: %v", format.SafeMarkdownCode(rawTarget), err)
+		return nil
+	}
+	return ident
+}
+
+func formatIdentity(ident *identity.Identity) string {
+	if ident.Handle.IsInvalidHandle() {
+		return format.SafeMarkdownCode(ident.DID)
+	}
+	return format.EscapeMarkdown("@" + ident.Handle.String())
+}
+
+func makeGraphCommand(
+	name, description, pastTense string, fn func(*BlueskyClient, context.Context, syntax.DID) error,
+) *commands.FullHandler {
+	return &commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			client := getCommandClient(ce)
+			if client == nil {
+				return
+			}
+			ident := resolveCommandTarget(ce, client)
+			if ident == nil {
+				return
+			}
+			err := fn(client, ce.Ctx, ident.DID)
+			switch {
+			case errors.Is(err, errAlreadyFollowing), errors.Is(err, errNotFollowing),
+				errors.Is(err, errAlreadyBlocking), errors.Is(err, errNotBlocking):
+				ce.Reply("You're %s %s", err, formatIdentity(ident))
+			case err != nil:
+				ce.Log.Err(err).Stringer("target_did", ident.DID).Str("action", name).Msg("Failed to update relationship")
+				ce.Reply("Failed to %s %s: %v", name, formatIdentity(ident), err)
+			default:
+				ce.Reply("%s %s", pastTense, formatIdentity(ident))
+			}
+		},
+		Name: name,
+		Help: commands.HelpMeta{
+			Section:     HelpSectionBluesky,
+			Description: description,
+			Args:        "[_handle or DID_]",
+		},
+		RequiresLogin: true,
+	}
+}
+
+func fnWhois(ce *commands.Event) {
+	client := getCommandClient(ce)
+	if client == nil {
+		return
+	}
+	ident := resolveCommandTarget(ce, client)
+	if ident == nil {
+		return
+	}
+	profile, viewer, err := client.getProfileWithViewer(ce.Ctx, ident.DID)
+	if err != nil {
+		ce.Log.Err(err).Stringer("target_did", ident.DID).Msg("Failed to get profile")
+		ce.Reply("Failed to get profile of %s: %v", formatIdentity(ident), err)
+		return
+	}
+	var out strings.Builder
+	if name := ptr.Val(profile.DisplayName); name != "" {
+		_, _ = fmt.Fprintf(&out, "**%s** (%s)\n\n", format.EscapeMarkdown(name), formatIdentity(ident))
+	} else {
+		_, _ = fmt.Fprintf(&out, "%s\n\n", formatIdentity(ident))
+	}
+	_, _ = fmt.Fprintf(&out, "* DID: %s\n", format.SafeMarkdownCode(ident.DID))
+	if pds := ident.PDSEndpoint(); pds != "" {
+		_, _ = fmt.Fprintf(&out, "* PDS: %s\n", format.EscapeMarkdown(pds))
+	}
+	_, _ = fmt.Fprintf(
+		&out, "* %d followers, %d following, %d posts\n",
+		ptr.Val(profile.FollowersCount), ptr.Val(profile.FollowsCount), ptr.Val(profile.PostsCount),
+	)
+	var relationship []string
+	if viewer.Following != nil {
+		relationship = append(relationship, "you follow them")
+	}
+	if viewer.FollowedBy != nil {
+		relationship = append(relationship, "they follow you")
+	}
+	if viewer.Blocking != nil || viewer.BlockingByList != nil {
+		relationship = append(relationship, "you've blocked them")
+	}
+	if ptr.Val(viewer.BlockedBy) {
+		relationship = append(relationship, "they've blocked you")
+	}
+	if isMuted(viewer) {
+		relationship = append(relationship, "you've muted them")
+	}
+	if len(relationship) > 0 {
+		_, _ = fmt.Fprintf(&out, "* Relationship: %s\n", strings.Join(relationship, ", "))
+	}
+	if description := ptr.Val(profile.Description); description != "" {
+		_, _ = fmt.Fprintf(&out, "\n%s", format.EscapeMarkdown(description))
+	}
+	ce.Reply(out.String())
+}
+
+func fnResync(ce *commands.Event) {
+	client := getCommandClient(ce)
+	if client == nil {
+		return
+	}
+	if otherUser := parseUserID(ce.Portal.OtherUserID); otherUser != "" {
+		client.Main.Profiles.Invalidate(otherUser.String())
+	}
+	client.UserLogin.QueueRemoteEvent(&simplevent.ChatResync{
+		EventMeta: simplevent.EventMeta{
+			Type: bridgev2.RemoteEventChatResync,
+			LogContext: func(c zerolog.Context) zerolog.Context {
+				return c.Str("chat_id", parsePortalID(ce.Portal.ID)).Bool("manual_resync", true)
+			},
+			PortalKey: ce.Portal.PortalKey,
+		},
+		GetChatInfoFunc: client.GetChatInfo,
+	})
+	ce.Reply("Queued resync of this chat")
+}
+
+func fnReport(ce *commands.Event) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `$cmdprefix report <spam/violation/misleading/sexual/rude/other> [comment]`")
+		return
+	}
+	reasonType, ok := reportReasons[strings.ToLower(ce.Args[0])]
+	if !ok {
+		ce.Reply("Unknown reason %s", format.SafeMarkdownCode(ce.Args[0]))
+		return
+	}
+	comment := strings.Join(ce.Args[1:], " ")
+	client := getCommandClient(ce)
+	if client == nil {
+		return
+	}
+	var err error
+	if ce.ReplyTo != "" {
+		msg, dbErr := ce.Bridge.DB.Message.GetPartByMXID(ce.Ctx, ce.ReplyTo)
+		if dbErr != nil {
+			ce.Log.Err(dbErr).Stringer("reply_to", ce.ReplyTo).Msg("Failed to get message to report")
+			ce.Reply("Failed to get message from database")
+			return
+		} else if msg == nil || msg.Room != ce.Portal.PortalKey {
+			ce.Reply("That message isn't bridged")
+			return
+		} else if client.IsThisUser(ce.Ctx, msg.SenderID) {
+			ce.Reply("You can't report your own messages")
+			return
+		}
+		portalID, messageID := parseMessageID(msg.ID)
+		_, err = client.reportMessage(ce.Ctx, parsePortalID(portalID), messageID, parseUserID(msg.SenderID).String(), reasonType, comment)
+	} else if otherUser := parseUserID(ce.Portal.OtherUserID); otherUser != "" {
+		_, err = client.reportAccount(ce.Ctx, otherUser.String(), reasonType, comment)
+	} else {
+		ce.Reply("Reply to a message to report it")
+		return
+	}
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to create report")
+		ce.Reply("Failed to send report: %v", err)
+		return
+	}
+	ce.Reply("Report sent")
+}
+
+func fnSetService(ce *commands.Event) {
+	var kind string
+	if len(ce.Args) > 0 {
+		kind = strings.ToLower(ce.Args[0])
+	}
+	if kind != "chat" && kind != "appview" {
+		ce.Reply("**Usage:** `$cmdprefix set-service <chat/appview> [service or default]`")
+		return
+	}
+	client := getCommandClient(ce)
+	if client == nil {
+		return
+	}
+	login := client.UserLogin
+	meta := login.Metadata.(*UserLoginMetadata)
+	newMeta := *meta
+	override := &newMeta.ChatService
+	if kind == "appview" {
+		override = &newMeta.AppViewService
+	}
+	if len(ce.Args) == 1 {
+		chatService, appViewService, _ := client.Main.getServices(meta)
+		current := chatService
+		if kind == "appview" {
+			current = appViewService
+		}
+		switch {
+		case current == "":
+			ce.Reply("Using the default %s service of your PDS", kind)
+		case *override == "":
+			ce.Reply("Using the default %s service: %s", kind, format.SafeMarkdownCode(current))
+		default:
+			ce.Reply("Using the overridden %s service: %s", kind, format.SafeMarkdownCode(current))
+		}
+		return
+	}
+	*override = ce.Args[1]
+	if strings.EqualFold(*override, "default") {
+		*override = ""
+	}
+	chatService, _, err := client.Main.getServices(&newMeta)
+	if err != nil {
+		ce.Reply("Invalid service: %v", err)
+		return
+	}
+	// Make sure the new chat service works before switching to it, as the login would be unusable otherwise.
+	err = checkChatAccess(ce.Ctx, &xrpc.Client{
+		Client:    client.XRPC.Client,
+		Host:      client.XRPC.Host,
+		Auth:      client.XRPC.Auth,
+		UserAgent: client.XRPC.UserAgent,
+		Headers:   proxyHeaders(chatService),
+	})
+	if err != nil {
+		ce.Log.Err(err).Str("chat_service", chatService).Msg("Chat access check failed with new service")
+		ce.Reply("Failed to access chats through %s: %v", format.SafeMarkdownCode(chatService), err)
+		return
+	}
+	meta.ChatService = newMeta.ChatService
+	meta.AppViewService = newMeta.AppViewService
+	err = login.Save(ce.Ctx)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to save login after changing service")
+		ce.Reply("Failed to save login: %v", err)
+		return
+	}
+	// The services are baked into the XRPC clients, so reload the login to apply the change.
+	client.Disconnect()
+	err = client.Main.LoadUserLogin(ce.Ctx, login)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to reload login after changing service")
+		ce.Reply("Saved the new service, but failed to reload the login: %v", err)
+		return
+	}
+	go login.Client.Connect(login.Log.WithContext(context.Background()))
+	ce.Reply("Updated the %s service, reconnecting", kind)
+}
@@ -18,17 +18,59 @@ package connector
 
 import (
 	_ "embed"
+	"fmt"
+	"io"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	up "go.mau.fi/util/configupgrade"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	DefaultChatService       = "did:web:api.bsky.chat#bsky_chat"
+	DefaultModerationService = "did:plc:ar7c4by46qjdydhdevvrndac#atproto_labeler"
+)
+
 type Config struct {
 	DisplaynameTemplate string `yaml:"displayname_template"`
 
+	ChatService       string `yaml:"chat_service"`
+	AppViewService    string `yaml:"appview_service"`
+	ModerationService string `yaml:"moderation_service"`
+
+	SplitLongMessages bool `yaml:"split_long_messages"`
+	MediaLinks        bool `yaml:"media_links"`
+	ReplyQuoteLength  int  `yaml:"reply_quote_length"`
+	EmulatedEdits     bool `yaml:"emulated_edits"`
+
+	RelayTemplate string `yaml:"relay_template"`
+
+	Fallbacks FallbackConfig `yaml:"message_fallbacks"`
+	HTTP      HTTPConfig     `yaml:"http"`
+
 	displaynameTemplate *template.Template `yaml:"-"`
+	relayTemplate       *template.Template `yaml:"-"`
+}
+
+// FallbackConfig controls which Matrix message types are sent to Bluesky as text fallbacks.
+// Disabled types are rejected.
+type FallbackConfig struct {
+	Emotes    bool `yaml:"emotes"`
+	Notices   bool `yaml:"notices"`
+	Locations bool `yaml:"locations"`
+	Stickers  bool `yaml:"stickers"`
+	Polls     bool `yaml:"polls"`
+}
+
+type HTTPConfig struct {
+	Proxy          string        `yaml:"proxy"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	MaxIdleConns   int           `yaml:"max_idle_conns"`
+	UserAgent      string        `yaml:"user_agent"`
 }
 
 //go:embed example-config.yaml
@@ -47,6 +89,54 @@ func (c *Config) UnmarshalYAML(node *yaml.Node) error {
 func (c *Config) PostProcess() error {
 	var err error
 	c.displaynameTemplate, err = template.New("displayname").Parse(c.DisplaynameTemplate)
+	if err != nil {
+		return err
+	}
+	// Check that the template only uses variables that exist, as FormatDisplayname panics on errors
+	if err = c.displaynameTemplate.Execute(io.Discard, &DisplaynameParams{}); err != nil {
+		return fmt.Errorf("invalid displayname_template: %w", err)
+	}
+	c.relayTemplate, err = template.New("relay").Parse(c.RelayTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid relay_template: %w", err)
+	}
+	if c.ChatService == "" {
+		c.ChatService = DefaultChatService
+	}
+	if err = validateServiceRef(c.ChatService); err != nil {
+		return fmt.Errorf("invalid chat_service: %w", err)
+	}
+	if c.ModerationService == "" {
+		c.ModerationService = DefaultModerationService
+	}
+	if err = validateServiceRef(c.ModerationService); err != nil {
+		return fmt.Errorf("invalid moderation_service: %w", err)
+	}
+	if c.AppViewService != "" {
+		if err = validateServiceRef(c.AppViewService); err != nil {
+			return fmt.Errorf("invalid appview_service: %w", err)
+		}
+	}
+	if c.HTTP.ConnectTimeout <= 0 {
+		c.HTTP.ConnectTimeout = 10 * time.Second
+	}
+	if c.HTTP.RequestTimeout <= 0 {
+		c.HTTP.RequestTimeout = 30 * time.Second
+	}
+	if c.HTTP.MaxIdleConns <= 0 {
+		c.HTTP.MaxIdleConns = 100
+	}
+	return nil
+}
+
+// validateServiceRef checks that the given string is a valid value for the Atproto-Proxy header,
+// i.e. a DID followed by a service ID fragment like `did:web:api.bsky.chat#bsky_chat`.
+func validateServiceRef(ref string) error {
+	did, serviceID, ok := strings.Cut(ref, "#")
+	if !ok || serviceID == "" {
+		return fmt.Errorf("%q is missing the service ID (e.g. #bsky_chat)", ref)
+	}
+	_, err := syntax.ParseDID(did)
 	return err
 }
 
@@ -54,23 +144,62 @@ type DisplaynameParams struct {
 	DisplayName string
 	Handle      string
 	DID         string
+
+	// These are only available when the full profile has been fetched
+	Description string
+	Pronouns    string
+	Website     string
+
+	// Verified is true if a trusted verifier has verified the user.
+	Verified bool
+	// TrustedVerifier is true if the user is a trusted verifier themselves.
+	TrustedVerifier bool
 }
 
-func (c *Config) FormatDisplayname(displayName, handle, did string) string {
+func (c *Config) FormatDisplayname(params *DisplaynameParams) string {
 	var nameBuf strings.Builder
-	err := c.displaynameTemplate.Execute(&nameBuf, DisplaynameParams{
-		DisplayName: displayName,
-		Handle:      handle,
-		DID:         did,
-	})
+	err := c.displaynameTemplate.Execute(&nameBuf, params)
 	if err != nil {
 		panic(err)
 	}
 	return nameBuf.String()
 }
 
+type RelayParams struct {
+	// DisplayName is the Matrix displayname of the sender, disambiguated with the user ID if necessary.
+	DisplayName string
+	UserID      string
+}
+
+func (c *Config) FormatRelayPrefix(params *RelayParams) string {
+	var prefixBuf strings.Builder
+	err := c.relayTemplate.Execute(&prefixBuf, params)
+	if err != nil {
+		panic(err)
+	}
+	return prefixBuf.String()
+}
+
 func upgradeConfig(helper up.Helper) {
 	helper.Copy(up.Str, "displayname_template")
+	helper.Copy(up.Str, "chat_service")
+	helper.Copy(up.Str, "appview_service")
+	helper.Copy(up.Str, "moderation_service")
+	helper.Copy(up.Bool, "split_long_messages")
+	helper.Copy(up.Bool, "media_links")
+	helper.Copy(up.Int, "reply_quote_length")
+	helper.Copy(up.Bool, "emulated_edits")
+	helper.Copy(up.Str, "relay_template")
+	helper.Copy(up.Bool, "message_fallbacks", "emotes")
+	helper.Copy(up.Bool, "message_fallbacks", "notices")
+	helper.Copy(up.Bool, "message_fallbacks", "locations")
+	helper.Copy(up.Bool, "message_fallbacks", "stickers")
+	helper.Copy(up.Bool, "message_fallbacks", "polls")
+	helper.Copy(up.Str|up.Null, "http", "proxy")
+	helper.Copy(up.Str, "http", "connect_timeout")
+	helper.Copy(up.Str, "http", "request_timeout")
+	helper.Copy(up.Int, "http", "max_idle_conns")
+	helper.Copy(up.Str|up.Null, "http", "user_agent")
 }
 
 func (b *BlueskyConnector) GetConfig() (example string, data any, upgrader up.Upgrader) {
@@ -18,13 +18,41 @@ package connector
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
+	"github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-retryablehttp"
+	"go.mau.fi/util/exhttp"
+	"go.mau.fi/util/exsync"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/status"
 )
 
 type BlueskyConnector struct {
-	Bridge *bridgev2.Bridge
-	Config Config
+	Bridge    *bridgev2.Bridge
+	Config    Config
+	Directory identity.Directory
+	OAuth     *oauth.ClientApp
+	// HTTPClient is the shared client used for all outgoing requests. It has the proxy and timeouts from the config applied.
+	HTTPClient *http.Client
+	// UserAgent is the User-Agent header sent with all requests. It always contains the bridge version.
+	UserAgent string
+	Media     *MediaFetcher
+	Profiles  *ProfileCache
+
+	oauthCallbacks *exsync.Map[string, chan url.Values]
+
+	identityRefreshes   map[syntax.DID]time.Time
+	identityRefreshLock sync.Mutex
 }
 
 var _ bridgev2.NetworkConnector = (*BlueskyConnector)(nil)
@@ -43,8 +71,73 @@ func (b *BlueskyConnector) GetName() bridgev2.BridgeName {
 
 func (b *BlueskyConnector) Init(bridge *bridgev2.Bridge) {
 	b.Bridge = bridge
+	b.Profiles = NewProfileCache(profileCacheTTL)
+	b.identityRefreshes = make(map[syntax.DID]time.Time)
+	b.registerCommands()
+	status.BridgeStateHumanErrors.Update(status.BridgeStateErrorMap{
+		"bsky-no-chat-access":    noChatAccessMessage,
+		"bsky-oauth-unavailable": "OAuth logins require the bridge's public address to be configured",
+	})
 }
 
 func (b *BlueskyConnector) Start(ctx context.Context) error {
+	err := b.initHTTPClient()
+	if err != nil {
+		return err
+	}
+	err = b.migrateGhostIDs(ctx)
+	if err != nil {
+		return err
+	}
+	err = b.migrateGroupPortalKeys(ctx)
+	if err != nil {
+		return err
+	}
+	b.initOAuth()
+	return nil
+}
+
+// initHTTPClient creates the shared HTTP client and identity directory based on the http section of the config.
+// The client retries failed requests the same way as indigo's RobustHTTPClient.
+func (b *BlueskyConnector) initHTTPClient() error {
+	cfg := &b.Config.HTTP
+	settings, err := exhttp.SensibleClientSettings.
+		WithDialTimeout(cfg.ConnectTimeout).
+		WithGlobalTimeout(cfg.RequestTimeout).
+		WithProxy(cfg.Proxy)
+	if err != nil {
+		return fmt.Errorf("invalid HTTP proxy: %w", err)
+	}
+	transport := settings.Configure(cleanhttp.DefaultPooledTransport())
+	transport.MaxIdleConns = cfg.MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConns
+	retryClient := retryablehttp.NewClient()
+	retryClient.HTTPClient.Transport = transport
+	retryClient.RetryMax = 3
+	retryClient.RetryWaitMin = 1 * time.Second
+	retryClient.RetryWaitMax = 10 * time.Second
+	retryClient.Logger = nil
+	retryClient.CheckRetry = util.XRPCRetryPolicy
+	b.HTTPClient = retryClient.StandardClient()
+	b.HTTPClient.Timeout = settings.GlobalTimeout
+
+	b.UserAgent = mautrix.DefaultUserAgent
+	if cfg.UserAgent != "" {
+		b.UserAgent = fmt.Sprintf("%s %s", cfg.UserAgent, mautrix.DefaultUserAgent)
+	}
+
+	b.Media = &MediaFetcher{
+		Client:    b.HTTPClient,
+		UserAgent: b.UserAgent,
+		MaxSize:   defaultMaxMediaSize,
+	}
+
+	b.Directory = identity.NewCacheDirectory(&identity.BaseDirectory{
+		PLCURL:                identity.DefaultPLCURL,
+		HTTPClient:            *b.HTTPClient,
+		TryAuthoritativeDNS:   true,
+		SkipDNSDomainSuffixes: []string{".bsky.social"},
+		UserAgent:             b.UserAgent,
+	}, 250_000, 24*time.Hour, 2*time.Minute, 5*time.Minute)
 	return nil
 }
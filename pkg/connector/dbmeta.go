@@ -17,15 +17,29 @@
 package connector
 
 import (
+	"context"
+	"slices"
+
+	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/bluesky-social/indigo/atproto/auth/oauth"
 	"github.com/bluesky-social/indigo/xrpc"
+	"go.mau.fi/util/jsontime"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
 )
 
 func (b *BlueskyConnector) GetDBMetaTypes() database.MetaTypes {
 	return database.MetaTypes{
-		Portal:   nil,
-		Ghost:    nil,
-		Message:  nil,
+		Portal: func() any {
+			return &PortalMetadata{}
+		},
+		Ghost: func() any {
+			return &GhostMetadata{}
+		},
+		Message: func() any {
+			return &MessageMetadata{}
+		},
 		Reaction: nil,
 		UserLogin: func() any {
 			return &UserLoginMetadata{}
@@ -33,8 +47,136 @@ func (b *BlueskyConnector) GetDBMetaTypes() database.MetaTypes {
 	}
 }
 
+var _ database.MetaMerger = (*UserLoginMetadata)(nil)
+
 type UserLoginMetadata struct {
-	Auth   *xrpc.AuthInfo `json:"auth"`
-	Host   string         `json:"host"`
-	Cursor string         `json:"cursor"`
+	// For OAuth logins, only the DID and handle are filled in Auth, the tokens are in the OAuth session data.
+	Auth   *xrpc.AuthInfo           `json:"auth"`
+	OAuth  *oauth.ClientSessionData `json:"oauth,omitempty"`
+	Host   string                   `json:"host"`
+	Cursor string                   `json:"cursor"`
+
+	// Per-login overrides for the chat_service and appview_service config options
+	ChatService    string `json:"chat_service,omitempty"`
+	AppViewService string `json:"appview_service,omitempty"`
+}
+
+// CopyFrom is called by bridgev2 when logging into an existing login again. The credentials are
+// replaced, but the log cursor is kept so that events aren't missed or bridged twice.
+func (m *UserLoginMetadata) CopyFrom(other any) {
+	otherMeta, ok := other.(*UserLoginMetadata)
+	if !ok {
+		return
+	}
+	m.Auth = otherMeta.Auth
+	m.OAuth = otherMeta.OAuth
+	m.Host = otherMeta.Host
+	if otherMeta.ChatService != "" {
+		m.ChatService = otherMeta.ChatService
+	}
+	if otherMeta.AppViewService != "" {
+		m.AppViewService = otherMeta.AppViewService
+	}
+	if m.Cursor == "" {
+		m.Cursor = otherMeta.Cursor
+	}
+}
+
+type PortalMetadata struct {
+	// Rev is the revision of the convo the last time it was synced.
+	Rev string `json:"rev,omitempty"`
+	// Status is the convo status, either `request` or `accepted`.
+	Status string `json:"status,omitempty"`
+	// BlockState is the block status between the user and the other member of a DM, see getBlockState.
+	BlockState blockState `json:"block_state,omitempty"`
+	// BackfillCursor is the getMessages cursor for fetching messages older than what has been backfilled so far.
+	BackfillCursor string `json:"backfill_cursor,omitempty"`
+	// Members are the sorted DIDs of the convo members, used to find who joined or left when membership changes.
+	Members []string `json:"members,omitempty"`
+}
+
+// updatePortalMetadata returns an ExtraUpdater that stores the rev, status, block state and members of the given convo
+// in the portal metadata. If the block state changes, a notice is sent to the room.
+func updatePortalMetadata(convo *chat.ConvoDefs_ConvoView, blocked blockState) bridgev2.ExtraUpdater[*bridgev2.Portal] {
+	return func(ctx context.Context, portal *bridgev2.Portal) bool {
+		meta := portal.Metadata.(*PortalMetadata)
+		status := ptr.Val(convo.Status)
+		members := getMemberDIDs(convo)
+		if meta.Rev == convo.Rev && meta.Status == status && meta.BlockState == blocked && slices.Equal(meta.Members, members) {
+			return false
+		}
+		if meta.BlockState != blocked && portal.MXID != "" {
+			sendBlockStateNotice(ctx, portal, blocked)
+		}
+		meta.Rev = convo.Rev
+		meta.Status = status
+		meta.BlockState = blocked
+		meta.Members = members
+		return true
+	}
+}
+
+func getMemberDIDs(convo *chat.ConvoDefs_ConvoView) []string {
+	members := make([]string, len(convo.Members))
+	for i, member := range convo.Members {
+		members[i] = member.Did
+	}
+	slices.Sort(members)
+	return members
+}
+
+type GhostMetadata struct {
+	Handle string `json:"handle,omitempty"`
+	// LastProfileFetch is when the full profile was last fetched by GetUserInfo, which uses it to throttle refetches.
+	LastProfileFetch jsontime.UnixMilli `json:"last_profile_fetch,omitempty"`
+}
+
+// updateGhostMetadata returns an ExtraUpdater that stores the handle in the ghost metadata.
+// If fullProfile is true, the last profile fetch timestamp is also bumped.
+func updateGhostMetadata(handle string, fullProfile bool) bridgev2.ExtraUpdater[*bridgev2.Ghost] {
+	return func(ctx context.Context, ghost *bridgev2.Ghost) bool {
+		meta := ghost.Metadata.(*GhostMetadata)
+		changed := meta.Handle != handle
+		meta.Handle = handle
+		if fullProfile {
+			meta.LastProfileFetch = jsontime.UnixMilliNow()
+			changed = true
+		}
+		return changed
+	}
+}
+
+type MessageMetadata struct {
+	// Rev is the revision of the message in the convo log.
+	Rev string `json:"rev,omitempty"`
+	// EmbedURI is the AT URI of the record embedded in the message, if any.
+	EmbedURI string `json:"embed_uri,omitempty"`
+	// Split is true if the Matrix event was sent as multiple Bluesky messages.
+	Split bool `json:"split,omitempty"`
+}
+
+func getEmbedURI(msg *chat.ConvoDefs_MessageView) string {
+	if msg.Embed == nil || msg.Embed.EmbedRecord_View == nil || msg.Embed.EmbedRecord_View.Record == nil {
+		return ""
+	}
+	switch record := msg.Embed.EmbedRecord_View.Record; {
+	case record.EmbedRecord_ViewRecord != nil:
+		return record.EmbedRecord_ViewRecord.Uri
+	case record.EmbedRecord_ViewNotFound != nil:
+		return record.EmbedRecord_ViewNotFound.Uri
+	case record.EmbedRecord_ViewBlocked != nil:
+		return record.EmbedRecord_ViewBlocked.Uri
+	case record.EmbedRecord_ViewDetached != nil:
+		return record.EmbedRecord_ViewDetached.Uri
+	case record.FeedDefs_GeneratorView != nil:
+		return record.FeedDefs_GeneratorView.Uri
+	case record.GraphDefs_ListView != nil:
+		return record.GraphDefs_ListView.Uri
+	case record.LabelerDefs_LabelerView != nil:
+		return record.LabelerDefs_LabelerView.Uri
+	case record.GraphDefs_StarterPackViewBasic != nil:
+		return record.GraphDefs_StarterPackViewBasic.Uri
+	default:
+		return ""
+	}
 }
@@ -0,0 +1,197 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+var _ bridgev2.PollHandlingNetworkAPI = (*BlueskyClient)(nil)
+
+// convertMatrixContent converts a Matrix message into text and an optional attachment message. Bluesky chats only
+// support plain text, so other message types are rendered as text fallbacks if they're enabled in the config.
+func (b *BlueskyClient) convertMatrixContent(
+	ctx context.Context, content *event.MessageEventContent, origSender *bridgev2.OrigSender,
+) (text string, attachment *chat.ConvoDefs_MessageInput, err error) {
+	fallbacks := &b.Main.Config.Fallbacks
+	switch content.MsgType {
+	case event.MsgText:
+		return content.Body, nil, nil
+	case event.MsgNotice:
+		if !fallbacks.Notices {
+			break
+		}
+		return content.Body, nil, nil
+	case event.MsgEmote:
+		if !fallbacks.Emotes {
+			break
+		}
+		name := b.UserLogin.RemoteName
+		if origSender != nil {
+			name = getRelayParams(origSender).DisplayName
+		}
+		return fmt.Sprintf("* %s %s", name, content.Body), nil, nil
+	case event.MsgLocation:
+		if !fallbacks.Locations {
+			break
+		}
+		attachment, err = makeLocationMessage(content)
+		return "", attachment, err
+	case event.CapMsgSticker:
+		if !fallbacks.Stickers {
+			break
+		}
+		// Stickers are linked only if media links are enabled, otherwise only the body is sent
+		mediaURL, err := b.getPublicMediaURL(ctx, content)
+		if err != nil {
+			// The link is optional for stickers, so send the body alone rather than failing the whole message
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to get public media URL for sticker")
+			return content.Body, nil, nil
+		} else if mediaURL == "" {
+			return content.Body, nil, nil
+		}
+		return "", makeLinkMessage(content.Body, mediaURL), nil
+	default:
+		mediaURL, err := b.getPublicMediaURL(ctx, content)
+		if err != nil {
+			return "", nil, err
+		} else if mediaURL == "" {
+			break
+		}
+		return content.GetCaption(), makeLinkMessage("📎 "+content.GetFileName(), mediaURL), nil
+	}
+	return "", nil, fmt.Errorf("%w %s", bridgev2.ErrUnsupportedMessageType, content.MsgType)
+}
+
+// getPublicMediaURL returns a public link to the given Matrix media. Bluesky chats can't contain files,
+// so media is only bridged if media_links is enabled and the bridge's public media endpoint is configured.
+// If media links aren't available, an empty string is returned.
+func (b *BlueskyClient) getPublicMediaURL(ctx context.Context, content *event.MessageEventContent) (string, error) {
+	if content.URL == "" && content.File == nil {
+		return "", nil
+	}
+	if !b.Main.mediaLinksEnabled() {
+		return "", nil
+	}
+	return b.Main.Bridge.Matrix.(bridgev2.MatrixConnectorWithPublicMedia).GetPublicMediaAddressForEvent(ctx, content)
+}
+
+// mediaLinksEnabled checks if media_links is enabled and public media is actually enabled in the bridge config.
+func (b *BlueskyConnector) mediaLinksEnabled() bool {
+	if !b.Config.MediaLinks {
+		return false
+	}
+	mpm, ok := b.Bridge.Matrix.(bridgev2.MatrixConnectorWithPublicMedia)
+	// There's no direct way to check if public media is enabled, but addresses are empty when it's disabled
+	return ok && mpm.GetPublicMediaAddress("mxc://example.com/media_links") != ""
+}
+
+// makeLinkMessage creates a message with the given label on the first line and a link on the second line.
+func makeLinkMessage(label, link string) *chat.ConvoDefs_MessageInput {
+	var text strings.Builder
+	if label != "" {
+		text.WriteString(label)
+		text.WriteString("\n")
+	}
+	linkStart := text.Len()
+	text.WriteString(link)
+	linkEnd := text.Len()
+	return &chat.ConvoDefs_MessageInput{
+		Text: text.String(),
+		Facets: []*bsky.RichtextFacet{{
+			Index: &bsky.RichtextFacet_ByteSlice{
+				ByteStart: int64(linkStart),
+				ByteEnd:   int64(linkEnd),
+			},
+			Features: []*bsky.RichtextFacet_Features_Elem{{
+				RichtextFacet_Link: &bsky.RichtextFacet_Link{Uri: link},
+			}},
+		}},
+	}
+}
+
+// makeLocationMessage renders a Matrix location as a map link.
+func makeLocationMessage(content *event.MessageEventContent) (*chat.ConvoDefs_MessageInput, error) {
+	lat, long, err := parseGeoURI(content.GeoURI)
+	if err != nil {
+		return nil, err
+	}
+	label := "📍 Location"
+	if content.Body != "" && !strings.HasPrefix(content.Body, "geo:") {
+		label = "📍 " + content.Body
+	}
+	mapURL := (&url.URL{
+		Scheme:   "https",
+		Host:     "www.openstreetmap.org",
+		RawQuery: url.Values{"mlat": {lat}, "mlon": {long}}.Encode(),
+		Fragment: fmt.Sprintf("map=15/%s/%s", lat, long),
+	}).String()
+	return makeLinkMessage(label, mapURL), nil
+}
+
+// parseGeoURI parses the coordinates from a geo URI like `geo:60.1699,24.9384;u=35`.
+func parseGeoURI(uri string) (lat, long string, err error) {
+	coords, ok := strings.CutPrefix(uri, "geo:")
+	if !ok {
+		return "", "", fmt.Errorf("invalid geo URI %q", uri)
+	}
+	coords, _, _ = strings.Cut(coords, ";")
+	parts := strings.Split(coords, ",")
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("invalid geo URI %q", uri)
+	}
+	for _, part := range parts[:2] {
+		if _, err = strconv.ParseFloat(part, 64); err != nil {
+			return "", "", fmt.Errorf("invalid coordinate in geo URI %q: %w", uri, err)
+		}
+	}
+	return parts[0], parts[1], nil
+}
+
+// HandleMatrixPollStart sends polls as a text message listing the question and answers.
+func (b *BlueskyClient) HandleMatrixPollStart(ctx context.Context, msg *bridgev2.MatrixPollStart) (*bridgev2.MatrixMessageResponse, error) {
+	if !b.Main.Config.Fallbacks.Polls {
+		return nil, bridgev2.ErrPollsNotSupported
+	}
+	poll := &msg.Content.PollStart
+	var text strings.Builder
+	text.WriteString("📊 ")
+	text.WriteString(poll.Question.Text)
+	for i, answer := range poll.Answers {
+		_, _ = fmt.Fprintf(&text, "\n%d. %s", i+1, answer.Text)
+	}
+	inputs, err := b.makeMessageInputs(b.makeReplyQuote(ctx, &msg.MatrixMessage)+text.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return b.sendMessageInputs(ctx, &msg.MatrixMessage, inputs)
+}
+
+// HandleMatrixPollVote rejects votes, as polls are only sent as text and there's nothing to vote on.
+func (b *BlueskyClient) HandleMatrixPollVote(ctx context.Context, msg *bridgev2.MatrixPollVote) (*bridgev2.MatrixMessageResponse, error) {
+	return nil, fmt.Errorf("%w: votes can't be bridged", bridgev2.ErrPollsNotSupported)
+}
@@ -0,0 +1,144 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"go.mau.fi/util/ptr"
+)
+
+const (
+	followCollection = "app.bsky.graph.follow"
+	blockCollection  = "app.bsky.graph.block"
+)
+
+var (
+	errAlreadyFollowing = errors.New("already following")
+	errNotFollowing     = errors.New("not following")
+	errAlreadyBlocking  = errors.New("already blocking")
+	errNotBlocking      = errors.New("not blocking")
+)
+
+// getProfileWithViewer fetches the profile of the given user including the viewer state of the logged-in user.
+// The profile cache strips the viewer state, so this always bypasses the cache.
+func (b *BlueskyClient) getProfileWithViewer(ctx context.Context, did syntax.DID) (*bsky.ActorDefs_ProfileViewDetailed, *bsky.ActorDefs_ViewerState, error) {
+	profile, err := bsky.ActorGetProfile(ctx, b.AppView, did.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	viewer := profile.Viewer
+	if viewer == nil {
+		viewer = &bsky.ActorDefs_ViewerState{}
+	}
+	return profile, viewer, nil
+}
+
+func (b *BlueskyClient) createGraphRecord(ctx context.Context, collection string, record lexutil.CBOR) error {
+	_, err := atproto.RepoCreateRecord(ctx, b.XRPC, &atproto.RepoCreateRecord_Input{
+		Collection: collection,
+		Repo:       b.XRPC.Auth.Did,
+		Record:     &lexutil.LexiconTypeDecoder{Val: record},
+	})
+	return err
+}
+
+func (b *BlueskyClient) deleteGraphRecord(ctx context.Context, rawURI string) error {
+	uri, err := syntax.ParseATURI(rawURI)
+	if err != nil {
+		return fmt.Errorf("failed to parse record URI: %w", err)
+	}
+	_, err = atproto.RepoDeleteRecord(ctx, b.XRPC, &atproto.RepoDeleteRecord_Input{
+		Collection: uri.Collection().String(),
+		Repo:       b.XRPC.Auth.Did,
+		Rkey:       uri.RecordKey().String(),
+	})
+	return err
+}
+
+func (b *BlueskyClient) follow(ctx context.Context, did syntax.DID) error {
+	_, viewer, err := b.getProfileWithViewer(ctx, did)
+	if err != nil {
+		return err
+	} else if viewer.Following != nil {
+		return errAlreadyFollowing
+	}
+	return b.createGraphRecord(ctx, followCollection, &bsky.GraphFollow{
+		CreatedAt: syntax.DatetimeNow().String(),
+		Subject:   did.String(),
+	})
+}
+
+func (b *BlueskyClient) unfollow(ctx context.Context, did syntax.DID) error {
+	_, viewer, err := b.getProfileWithViewer(ctx, did)
+	if err != nil {
+		return err
+	} else if viewer.Following == nil {
+		return errNotFollowing
+	}
+	return b.deleteGraphRecord(ctx, *viewer.Following)
+}
+
+func (b *BlueskyClient) block(ctx context.Context, did syntax.DID) error {
+	_, viewer, err := b.getProfileWithViewer(ctx, did)
+	if err != nil {
+		return err
+	} else if viewer.Blocking != nil {
+		return errAlreadyBlocking
+	}
+	err = b.createGraphRecord(ctx, blockCollection, &bsky.GraphBlock{
+		CreatedAt: syntax.DatetimeNow().String(),
+		Subject:   did.String(),
+	})
+	if err == nil {
+		b.resyncDMWith(ctx, did)
+	}
+	return err
+}
+
+// unblock deletes the block record for the given user. Blocks made via block lists can't be removed this way.
+func (b *BlueskyClient) unblock(ctx context.Context, did syntax.DID) error {
+	_, viewer, err := b.getProfileWithViewer(ctx, did)
+	if err != nil {
+		return err
+	} else if viewer.Blocking == nil {
+		return errNotBlocking
+	}
+	err = b.deleteGraphRecord(ctx, *viewer.Blocking)
+	if err == nil {
+		b.resyncDMWith(ctx, did)
+	}
+	return err
+}
+
+// setMuted mutes or unmutes the given user. Mutes are private and stored by the AppView rather than in the repo.
+func (b *BlueskyClient) setMuted(ctx context.Context, did syntax.DID, muted bool) error {
+	if muted {
+		return bsky.GraphMuteActor(ctx, b.AppView, &bsky.GraphMuteActor_Input{Actor: did.String()})
+	}
+	return bsky.GraphUnmuteActor(ctx, b.AppView, &bsky.GraphUnmuteActor_Input{Actor: did.String()})
+}
+
+func isMuted(viewer *bsky.ActorDefs_ViewerState) bool {
+	return ptr.Val(viewer.Muted) || viewer.MutedByList != nil
+}
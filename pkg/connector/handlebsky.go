@@ -19,12 +19,14 @@ package connector
 import (
 	"context"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/chat"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/bridgev2/simplevent"
 	"maunium.net/go/mautrix/event"
 )
@@ -34,16 +36,160 @@ func (b *BlueskyClient) HandleEvent(ctx context.Context, evt *chat.ConvoGetLog_O
 	switch {
 	case evt.ConvoDefs_LogCreateMessage != nil:
 		b.HandleNewMessage(ctx, evt.ConvoDefs_LogCreateMessage)
+	case evt.ConvoDefs_LogBeginConvo != nil:
+		b.HandleBeginConvo(ctx, evt.ConvoDefs_LogBeginConvo)
+	case evt.ConvoDefs_LogLeaveConvo != nil:
+		b.HandleLeaveConvo(ctx, evt.ConvoDefs_LogLeaveConvo)
+	case evt.ConvoDefs_LogAddMember != nil:
+		b.HandleMemberChange(ctx, evt.ConvoDefs_LogAddMember.ConvoId, evt.ConvoDefs_LogAddMember.Rev)
+	case evt.ConvoDefs_LogRemoveMember != nil:
+		b.HandleMemberChange(ctx, evt.ConvoDefs_LogRemoveMember.ConvoId, evt.ConvoDefs_LogRemoveMember.Rev)
 	default:
 	}
 }
 
+func (b *BlueskyClient) HandleBeginConvo(ctx context.Context, evt *chat.ConvoDefs_LogBeginConvo) {
+	b.groupConvos.Delete(evt.ConvoId)
+	portalKey, _ := b.getPortalKey(ctx, evt.ConvoId)
+	b.UserLogin.QueueRemoteEvent(&simplevent.ChatResync{
+		EventMeta: simplevent.EventMeta{
+			Type: bridgev2.RemoteEventChatResync,
+			LogContext: func(c zerolog.Context) zerolog.Context {
+				return c.Str("chat_id", evt.ConvoId).Str("rev", evt.Rev)
+			},
+			PortalKey:    portalKey,
+			CreatePortal: true,
+		},
+		GetChatInfoFunc: b.GetChatInfo,
+	})
+}
+
+func (b *BlueskyClient) HandleLeaveConvo(ctx context.Context, evt *chat.ConvoDefs_LogLeaveConvo) {
+	portalKey, isGroup := b.getPortalKey(ctx, evt.ConvoId)
+	// The user may be added back later, so the group status has to be checked again then
+	b.groupConvos.Delete(evt.ConvoId)
+	meta := simplevent.EventMeta{
+		LogContext: func(c zerolog.Context) zerolog.Context {
+			return c.Str("chat_id", evt.ConvoId).Str("rev", evt.Rev)
+		},
+		PortalKey: portalKey,
+	}
+	if !isGroup {
+		zerolog.Ctx(ctx).Debug().Str("chat_id", evt.ConvoId).Msg("Ignoring leave log entry for DM")
+		return
+	}
+	self, err := b.makeEventSender(b.XRPC.Auth.Did)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to make event sender for self")
+		return
+	}
+	meta.Type = bridgev2.RemoteEventChatInfoChange
+	meta.Sender = self
+	b.UserLogin.QueueRemoteEvent(&simplevent.ChatInfoChange{
+		EventMeta: meta,
+		ChatInfoChange: &bridgev2.ChatInfoChange{
+			MemberChanges: &bridgev2.ChatMemberList{
+				MemberMap: map[networkid.UserID]bridgev2.ChatMember{
+					self.Sender: {EventSender: self, Membership: event.MembershipLeave},
+				},
+			},
+		},
+	})
+}
+
+// HandleMemberChange bridges other members being added to or removed from a convo. The log entries don't include
+// the member list, so the convo is fetched and compared to the members stored in the portal metadata.
+func (b *BlueskyClient) HandleMemberChange(ctx context.Context, convoID, rev string) {
+	log := zerolog.Ctx(ctx).With().Str("chat_id", convoID).Str("rev", rev).Logger()
+	// Membership changes can turn a DM into a group, so the cached status can't be used
+	b.groupConvos.Delete(convoID)
+	resp, err := chat.ConvoGetConvo(ctx, b.ChatRPC, convoID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get convo info after membership change")
+		return
+	}
+	portalKey := b.portalKeyForConvo(ctx, resp.Convo)
+	if dmKey := b.makePortalKey(convoID, false); portalKey != dmKey {
+		// If the convo was a DM before this change, move the existing DM portal to the shared group key,
+		// as the old portal would never be found again otherwise. This is a no-op if there's no DM portal.
+		result, _, err := b.Main.Bridge.ReIDPortal(ctx, dmKey, portalKey)
+		if err != nil {
+			log.Err(err).Msg("Failed to move DM portal to group portal key")
+			return
+		} else if result != bridgev2.ReIDResultNoOp {
+			log.Debug().Int("result", int(result)).Msg("Moved DM portal to group portal key")
+		}
+	}
+	portal, err := b.Main.Bridge.GetExistingPortalByKey(ctx, portalKey)
+	if err != nil {
+		log.Err(err).Msg("Failed to get portal for membership change")
+		return
+	}
+	meta := simplevent.EventMeta{
+		LogContext: func(c zerolog.Context) zerolog.Context {
+			return c.Str("chat_id", convoID).Str("rev", rev)
+		},
+		PortalKey: portalKey,
+	}
+	info := b.wrapChatInfo(ctx, resp.Convo)
+	if portal == nil || portal.MXID == "" || len(portal.Metadata.(*PortalMetadata).Members) == 0 || portal.RoomType != *info.Type {
+		// There's no previous member list to compare to, or the DM turned into a group
+		// and the name and avatar need to be updated too, so just sync the full info
+		meta.Type = bridgev2.RemoteEventChatResync
+		meta.CreatePortal = true
+		b.UserLogin.QueueRemoteEvent(&simplevent.ChatResync{
+			EventMeta: meta,
+			ChatInfo:  info,
+		})
+		return
+	}
+	meta.Type = bridgev2.RemoteEventChatInfoChange
+	b.UserLogin.QueueRemoteEvent(&simplevent.ChatInfoChange{
+		EventMeta:      meta,
+		ChatInfoChange: b.makeMemberChanges(ctx, info, portal.Metadata.(*PortalMetadata).Members),
+	})
+}
+
+// makeMemberChanges converts full chat info into a ChatInfoChange which only includes the members
+// that joined or left compared to the given previous member DIDs.
+func (b *BlueskyClient) makeMemberChanges(ctx context.Context, info *bridgev2.ChatInfo, previous []string) *bridgev2.ChatInfoChange {
+	changes := &bridgev2.ChatMemberList{
+		MemberMap: make(map[networkid.UserID]bridgev2.ChatMember),
+	}
+	current := make(map[networkid.UserID]struct{}, len(info.Members.MemberMap))
+	for userID, member := range info.Members.MemberMap {
+		current[userID] = struct{}{}
+		if !slices.Contains(previous, string(parseUserID(userID))) {
+			changes.MemberMap[userID] = member
+		}
+	}
+	for _, did := range previous {
+		evtSender, err := b.makeEventSender(did)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Str("member_did", did).Msg("Failed to parse previous member DID")
+			continue
+		} else if _, ok := current[evtSender.Sender]; ok {
+			continue
+		}
+		changes.MemberMap[evtSender.Sender] = bridgev2.ChatMember{
+			EventSender: evtSender,
+			Membership:  event.MembershipLeave,
+		}
+	}
+	info.Members = nil
+	return &bridgev2.ChatInfoChange{
+		ChatInfo:      info,
+		MemberChanges: changes,
+	}
+}
+
 func (b *BlueskyClient) HandleNewMessage(ctx context.Context, evt *chat.ConvoDefs_LogCreateMessage) {
-	sender, sentAt, msgID, msgData, err := b.parseMessageDetails(evt.Message.ConvoDefs_MessageView, evt.Message.ConvoDefs_DeletedMessageView)
+	sender, sentAt, msgID, rev, msgData, err := b.parseMessageDetails(evt.Message.ConvoDefs_MessageView, evt.Message.ConvoDefs_DeletedMessageView)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to parse message details")
 		return
 	}
+	portalKey, _ := b.getPortalKey(ctx, evt.ConvoId)
 	b.UserLogin.QueueRemoteEvent(&simplevent.Message[any]{
 		EventMeta: simplevent.EventMeta{
 			Type: bridgev2.RemoteEventMessage,
@@ -54,31 +200,33 @@ func (b *BlueskyClient) HandleNewMessage(ctx context.Context, evt *chat.ConvoDef
 					Str("message_id", msgID).
 					Str("sender_id", string(sender.Sender))
 			},
-			PortalKey:    b.makePortalKey(evt.ConvoId),
+			PortalKey:    portalKey,
 			Sender:       sender,
 			CreatePortal: true,
 			Timestamp:    sentAt,
-			StreamOrder:  sentAt.UnixMilli(),
+			StreamOrder:  makeStreamOrder(rev, sentAt),
 		},
 		Data:               msgData,
 		ID:                 makeMessageID(makePortalID(evt.ConvoId), msgID),
-		ConvertMessageFunc: convertMessage,
+		ConvertMessageFunc: b.convertMessage,
 	})
 }
 
 func (b *BlueskyClient) parseMessageDetails(
 	msgView *chat.ConvoDefs_MessageView, deletedMsgView *chat.ConvoDefs_DeletedMessageView,
-) (evtSender bridgev2.EventSender, sentAt time.Time, msgID string, msgData any, err error) {
+) (evtSender bridgev2.EventSender, sentAt time.Time, msgID, rev string, msgData any, err error) {
 	var senderDID, sentAtStr string
 	if msgView != nil {
 		senderDID = msgView.Sender.Did
 		sentAtStr = msgView.SentAt
 		msgID = msgView.Id
+		rev = msgView.Rev
 		msgData = msgView
 	} else if deletedMsgView != nil {
 		senderDID = deletedMsgView.Sender.Did
 		sentAtStr = deletedMsgView.SentAt
 		msgID = deletedMsgView.Id
+		rev = deletedMsgView.Rev
 		msgData = deletedMsgView
 	} else {
 		err = fmt.Errorf("no message view or deleted message view")
@@ -97,15 +245,21 @@ func (b *BlueskyClient) parseMessageDetails(
 	return
 }
 
-func convertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data any) (*bridgev2.ConvertedMessage, error) {
+func (b *BlueskyClient) convertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data any) (*bridgev2.ConvertedMessage, error) {
 	switch typedData := any(data).(type) {
 	case *chat.ConvoDefs_MessageView:
+		replyTo, text := b.findQuotedMessage(ctx, portal, typedData)
 		return &bridgev2.ConvertedMessage{
+			ReplyTo: replyTo,
 			Parts: []*bridgev2.ConvertedMessagePart{{
 				Type: event.EventMessage,
 				Content: &event.MessageEventContent{
 					MsgType: event.MsgText,
-					Body:    typedData.Text,
+					Body:    text,
+				},
+				DBMetadata: &MessageMetadata{
+					Rev:      typedData.Rev,
+					EmbedURI: getEmbedURI(typedData),
 				},
 			}},
 		}, nil
@@ -117,6 +271,9 @@ func convertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev
 					MsgType: event.MsgNotice,
 					Body:    "Deleted message",
 				},
+				DBMetadata: &MessageMetadata{
+					Rev: typedData.Rev,
+				},
 			}},
 		}, nil
 	default:
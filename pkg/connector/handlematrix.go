@@ -18,50 +18,255 @@ package connector
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 
 	"github.com/bluesky-social/indigo/api/chat"
 	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/rivo/uniseg"
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
 )
 
 var (
 	_ bridgev2.ReadReceiptHandlingNetworkAPI = (*BlueskyClient)(nil)
+	_ bridgev2.EditHandlingNetworkAPI        = (*BlueskyClient)(nil)
+	_ bridgev2.RedactionHandlingNetworkAPI   = (*BlueskyClient)(nil)
 )
 
+var errMessageTooLong = bridgev2.WrapErrorInStatus(errors.New("message is too long")).
+	WithErrorAsMessage().WithSendNotice(true).WithErrorReason(event.MessageStatusUnsupported)
+
+var errRelayedEditsNotSupported = bridgev2.WrapErrorInStatus(errors.New("edits from relayed users can't be bridged")).
+	WithIsCertain(true).WithErrorAsMessage().WithSendNotice(true).WithErrorReason(event.MessageStatusUnsupported)
+
+var errRelayedRedactionsNotSupported = bridgev2.WrapErrorInStatus(errors.New("deletions from relayed users can't be bridged")).
+	WithIsCertain(true).WithErrorAsMessage().WithSendNotice(true).WithErrorReason(event.MessageStatusUnsupported)
+
+var errCantEditSplitMessage = bridgev2.WrapErrorInStatus(errors.New("messages that were split into multiple parts can't be edited")).
+	WithErrorAsMessage().WithSendNotice(true).WithErrorReason(event.MessageStatusUnsupported)
+
+// editedMarker is appended to emulated edits, as the original message is only deleted for the user themselves.
+const editedMarker = " (edited)"
+
 func (b *BlueskyClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.MatrixMessage) (message *bridgev2.MatrixMessageResponse, err error) {
-	if !msg.Content.MsgType.IsText() {
-		return nil, fmt.Errorf("%w %s", bridgev2.ErrUnsupportedMessageType, msg.Content.MsgType)
-	}
-	resp, err := chat.ConvoSendMessage(ctx, b.ChatRPC, &chat.ConvoSendMessage_Input{
-		ConvoId: parsePortalID(msg.Portal.ID),
-		Message: &chat.ConvoDefs_MessageInput{
-			Text: msg.Content.Body,
-		},
-	})
+	text, attachment, err := b.convertMatrixContent(ctx, msg.Content, msg.OrigSender)
 	if err != nil {
 		return nil, err
 	}
-	sentAt, err := syntax.ParseDatetimeTime(resp.SentAt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse sentAt: %w", err)
+	// Emotes already include the sender name, so they don't need the relay prefix
+	if msg.OrigSender != nil && msg.Content.MsgType != event.MsgEmote {
+		prefix := b.Main.Config.FormatRelayPrefix(getRelayParams(msg.OrigSender))
+		if text != "" {
+			text = prefix + text
+		} else if attachment != nil {
+			prependText(attachment, prefix)
+		}
 	}
-	senderID, err := makeUserIDFromString(resp.Sender.Did)
+	if quote := b.makeReplyQuote(ctx, msg); quote != "" {
+		text = quote + text
+	}
+	inputs, err := b.makeMessageInputs(text, attachment)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse sender DID: %w", err)
+		return nil, err
 	}
-	return &bridgev2.MatrixMessageResponse{
-		DB: &database.Message{
-			ID:        makeMessageID(msg.Portal.ID, resp.Id),
+	return b.sendMessageInputs(ctx, msg, inputs)
+}
+
+func getRelayParams(origSender *bridgev2.OrigSender) *RelayParams {
+	name := origSender.DisambiguatedName
+	if name == "" {
+		name = origSender.UserID.String()
+	}
+	return &RelayParams{
+		DisplayName: name,
+		UserID:      origSender.UserID.String(),
+	}
+}
+
+// prependText adds the given prefix to the message text and shifts the facets accordingly,
+// as facet indexes are byte offsets in the text.
+func prependText(input *chat.ConvoDefs_MessageInput, prefix string) {
+	input.Text = prefix + input.Text
+	for _, facet := range input.Facets {
+		facet.Index.ByteStart += int64(len(prefix))
+		facet.Index.ByteEnd += int64(len(prefix))
+	}
+}
+
+// makeMessageInputs splits the given text into messages if necessary and appends the attachment message, if any.
+func (b *BlueskyClient) makeMessageInputs(text string, attachment *chat.ConvoDefs_MessageInput) ([]*chat.ConvoDefs_MessageInput, error) {
+	var inputs []*chat.ConvoDefs_MessageInput
+	if text != "" {
+		texts := []string{text}
+		if uniseg.GraphemeClusterCount(text) > maxMessageGraphemes {
+			if !b.Main.Config.SplitLongMessages {
+				return nil, errMessageTooLong
+			}
+			texts = splitText(text, maxMessageGraphemes)
+		}
+		for _, part := range texts {
+			inputs = append(inputs, &chat.ConvoDefs_MessageInput{Text: part})
+		}
+	}
+	if attachment != nil {
+		inputs = append(inputs, attachment)
+	}
+	if len(inputs) > maxMessageSplitParts {
+		return nil, errMessageTooLong
+	} else if len(inputs) == 0 {
+		return nil, fmt.Errorf("message is empty")
+	}
+	return inputs, nil
+}
+
+// sendMessageInputs sends the given messages to the convo of the portal. If there are multiple messages,
+// the first one is returned to be saved by bridgev2 and the rest are saved here as extra parts with fake MXIDs,
+// as the message table doesn't allow multiple rows with the same MXID. Saving the extra parts is required,
+// as their echoes from the convo log would otherwise be bridged back as new messages.
+func (b *BlueskyClient) sendMessageInputs(
+	ctx context.Context, msg *bridgev2.MatrixMessage, inputs []*chat.ConvoDefs_MessageInput,
+) (*bridgev2.MatrixMessageResponse, error) {
+	portal := msg.Portal
+	convoID := parsePortalID(portal.ID)
+	var sent []*chat.ConvoDefs_MessageView
+	if len(inputs) == 1 {
+		resp, err := chat.ConvoSendMessage(ctx, b.ChatRPC, &chat.ConvoSendMessage_Input{
+			ConvoId: convoID,
+			Message: inputs[0],
+		})
+		if err != nil {
+			return nil, err
+		}
+		sent = []*chat.ConvoDefs_MessageView{resp}
+	} else {
+		// Batches are sent atomically and in order, so either all parts go through or none do
+		items := make([]*chat.ConvoSendMessageBatch_BatchItem, len(inputs))
+		for i, input := range inputs {
+			items[i] = &chat.ConvoSendMessageBatch_BatchItem{
+				ConvoId: convoID,
+				Message: input,
+			}
+		}
+		resp, err := chat.ConvoSendMessageBatch(ctx, b.ChatRPC, &chat.ConvoSendMessageBatch_Input{Items: items})
+		if err != nil {
+			return nil, err
+		} else if len(resp.Items) != len(inputs) {
+			return nil, fmt.Errorf("batch send response contained %d messages, expected %d", len(resp.Items), len(inputs))
+		}
+		sent = resp.Items
+	}
+	dbMessages := make([]*database.Message, len(sent))
+	for i, resp := range sent {
+		sentAt, err := syntax.ParseDatetimeTime(resp.SentAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sentAt: %w", err)
+		}
+		senderID, err := makeUserIDFromString(resp.Sender.Did)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sender DID: %w", err)
+		}
+		dbMessages[i] = &database.Message{
+			ID:        makeMessageID(portal.ID, resp.Id),
 			SenderID:  senderID,
 			Timestamp: sentAt,
-		},
-		StreamOrder: sentAt.UnixMilli(),
+			Metadata:  &MessageMetadata{Rev: resp.Rev, Split: len(sent) > 1},
+		}
+		if i > 0 {
+			dbMessages[i].PartID = networkid.PartID(strconv.Itoa(i))
+			dbMessages[i].Room = portal.PortalKey
+			dbMessages[i].SenderMXID = msg.Event.Sender
+			dbMessages[i].SetFakeMXID()
+		}
+	}
+	if len(dbMessages) > 1 {
+		err := b.saveExtraParts(ctx, dbMessages[1:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	last := sent[len(sent)-1]
+	return &bridgev2.MatrixMessageResponse{
+		DB:          dbMessages[0],
+		StreamOrder: makeStreamOrder(last.Rev, dbMessages[len(dbMessages)-1].Timestamp),
 	}, nil
 }
 
+func (b *BlueskyClient) saveExtraParts(ctx context.Context, parts []*database.Message) error {
+	// bridgev2 only creates the sender's ghost row when saving the first part, which happens after this
+	_, err := b.Main.Bridge.GetGhostByID(ctx, parts[0].SenderID)
+	if err != nil {
+		return fmt.Errorf("failed to get sender ghost for message parts: %w", err)
+	}
+	return b.Main.Bridge.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, part := range parts {
+			err := b.Main.Bridge.DB.Message.Insert(ctx, part)
+			if err != nil {
+				return fmt.Errorf("failed to save message part %s: %w", part.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// HandleMatrixEdit emulates edits by sending the new text as a new message and deleting the original one.
+// Bluesky only allows deleting messages for yourself, so the other participants will see both messages.
+func (b *BlueskyClient) HandleMatrixEdit(ctx context.Context, msg *bridgev2.MatrixEdit) error {
+	if !b.Main.Config.EmulatedEdits {
+		return bridgev2.ErrEditsNotSupported
+	} else if msg.OrigSender != nil {
+		// Relayed messages are all sent by the relay login, so the edit target can't be verified to be from the same user
+		return errRelayedEditsNotSupported
+	} else if !msg.Content.MsgType.IsText() {
+		return fmt.Errorf("%w %s", bridgev2.ErrUnsupportedMessageType, msg.Content.MsgType)
+	} else if msg.EditTarget.Metadata.(*MessageMetadata).Split {
+		return errCantEditSplitMessage
+	}
+	text, _, err := b.convertMatrixContent(ctx, msg.Content, nil)
+	if err != nil {
+		return err
+	}
+	text += editedMarker
+	if uniseg.GraphemeClusterCount(text) > maxMessageGraphemes {
+		return errMessageTooLong
+	}
+	convoID := parsePortalID(msg.Portal.ID)
+	_, origMsgID := parseMessageID(msg.EditTarget.ID)
+	resp, err := chat.ConvoSendMessage(ctx, b.ChatRPC, &chat.ConvoSendMessage_Input{
+		ConvoId: convoID,
+		Message: &chat.ConvoDefs_MessageInput{Text: text},
+	})
+	if err != nil {
+		return err
+	}
+	// The new message was already sent, so a failed delete shouldn't fail the edit
+	_, err = chat.ConvoDeleteMessageForSelf(ctx, b.ChatRPC, &chat.ConvoDeleteMessageForSelf_Input{
+		ConvoId:   convoID,
+		MessageId: origMsgID,
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("orig_message_id", origMsgID).Msg("Failed to delete original message after edit")
+	}
+	// Point the existing database row at the new message, so that later events target the right message
+	msg.EditTarget.ID = makeMessageID(msg.Portal.ID, resp.Id)
+	msg.EditTarget.Metadata.(*MessageMetadata).Rev = resp.Rev
+	return nil
+}
+
+// HandleMatrixMessageRemove doesn't delete anything, as Bluesky only allows deleting messages for yourself.
+// It exists so that redactions from relayed users are rejected with a clear error instead of the generic one.
+// Relayed reactions never reach the connector, bridgev2 rejects them with ErrIgnoringReactionFromRelayedUser.
+func (b *BlueskyClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev2.MatrixMessageRemove) error {
+	if msg.OrigSender != nil {
+		return errRelayedRedactionsNotSupported
+	}
+	return bridgev2.ErrRedactionsNotSupported
+}
+
 func (b *BlueskyClient) HandleMatrixReadReceipt(ctx context.Context, msg *bridgev2.MatrixReadReceipt) error {
 	var msgID *string
 	if msg.ExactMessage != nil {
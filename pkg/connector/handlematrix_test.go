@@ -0,0 +1,312 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	_ "go.mau.fi/util/dbutil/litestream"
+	"gopkg.in/yaml.v3"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	testUserDID     = "did:plc:testsender"
+	testConvoID     = "testconvo"
+	testRoomID      = id.RoomID("!testroom:example.com")
+	testEventID     = id.EventID("$testevent")
+	testMatrixUser  = id.UserID("@alice:example.com")
+	testPublicMedia = "https://bridge.example.com/media/"
+)
+
+// testMatrixConnector implements the parts of the Matrix connector used when sending messages.
+// Everything else panics, as the embedded interface is nil.
+type testMatrixConnector struct {
+	bridgev2.MatrixConnector
+}
+
+var _ bridgev2.MatrixConnectorWithPublicMedia = (*testMatrixConnector)(nil)
+
+func (tmc *testMatrixConnector) Init(*bridgev2.Bridge) {}
+
+func (tmc *testMatrixConnector) BotIntent() bridgev2.MatrixAPI {
+	return nil
+}
+
+func (tmc *testMatrixConnector) GhostIntent(networkid.UserID) bridgev2.MatrixAPI {
+	return nil
+}
+
+func (tmc *testMatrixConnector) GetPublicMediaAddress(contentURI id.ContentURIString) string {
+	return testPublicMedia + strings.TrimPrefix(string(contentURI), "mxc://")
+}
+
+func (tmc *testMatrixConnector) GetPublicMediaAddressForEvent(ctx context.Context, content *event.MessageEventContent) (string, error) {
+	return tmc.GetPublicMediaAddress(content.URL), nil
+}
+
+// testChatServer is a minimal stand-in for the Bluesky chat service that records sent messages.
+type testChatServer struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	lock sync.Mutex
+	sent []string
+}
+
+type testMessageInput struct {
+	ConvoID string `json:"convoId"`
+	Message struct {
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+func newTestChatServer(t *testing.T) *testChatServer {
+	cs := &testChatServer{t: t}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /xrpc/chat.bsky.convo.sendMessage", cs.serveSendMessage)
+	mux.HandleFunc("POST /xrpc/chat.bsky.convo.sendMessageBatch", cs.serveSendMessageBatch)
+	cs.srv = httptest.NewServer(mux)
+	t.Cleanup(cs.srv.Close)
+	return cs
+}
+
+func (cs *testChatServer) addMessage(input *testMessageInput) map[string]any {
+	assert.Equal(cs.t, testConvoID, input.ConvoID)
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.sent = append(cs.sent, input.Message.Text)
+	return map[string]any{
+		"id":     fmt.Sprintf("msg%d", len(cs.sent)),
+		"rev":    fmt.Sprintf("rev%03d", len(cs.sent)),
+		"text":   input.Message.Text,
+		"sender": map[string]any{"did": testUserDID},
+		"sentAt": "2026-10-18T12:00:00.000Z",
+	}
+}
+
+func (cs *testChatServer) getSent() []string {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.sent
+}
+
+func (cs *testChatServer) serveSendMessage(w http.ResponseWriter, r *http.Request) {
+	var input testMessageInput
+	if !assert.NoError(cs.t, json.NewDecoder(r.Body).Decode(&input)) {
+		writeTestJSON(w, http.StatusBadRequest, map[string]string{"error": "InvalidRequest"})
+		return
+	}
+	writeTestJSON(w, http.StatusOK, cs.addMessage(&input))
+}
+
+func (cs *testChatServer) serveSendMessageBatch(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Items []*testMessageInput `json:"items"`
+	}
+	if !assert.NoError(cs.t, json.NewDecoder(r.Body).Decode(&input)) {
+		writeTestJSON(w, http.StatusBadRequest, map[string]string{"error": "InvalidRequest"})
+		return
+	}
+	items := make([]map[string]any, len(input.Items))
+	for i, item := range input.Items {
+		items[i] = cs.addMessage(item)
+	}
+	writeTestJSON(w, http.StatusOK, map[string]any{"items": items})
+}
+
+// newTestClient creates a client backed by an in-memory database and a test chat server,
+// along with a portal for testConvoID.
+func newTestClient(t *testing.T) (*BlueskyClient, *bridgev2.Portal, *testChatServer) {
+	ctx := context.Background()
+	rawDB, err := dbutil.NewFromConfig("", dbutil.Config{
+		PoolConfig: dbutil.PoolConfig{
+			Type:         "sqlite3-fk-wal",
+			URI:          ":memory:?_txlock=immediate",
+			MaxOpenConns: 1,
+			MaxIdleConns: 1,
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = rawDB.Close()
+	})
+	connector := &BlueskyConnector{}
+	require.NoError(t, yaml.Unmarshal([]byte(ExampleConfig), &connector.Config))
+	connector.Config.MediaLinks = true
+	br := bridgev2.NewBridge("bluesky", rawDB, zerolog.Nop(), nil, &testMatrixConnector{}, connector, func(*bridgev2.Bridge) bridgev2.CommandProcessor {
+		return nil
+	})
+	require.NoError(t, br.DB.Upgrade(ctx))
+	dbPortal := &database.Portal{
+		BridgeID:  br.ID,
+		PortalKey: networkid.PortalKey{ID: makePortalID(testConvoID)},
+		MXID:      testRoomID,
+		Metadata:  &PortalMetadata{},
+	}
+	require.NoError(t, br.DB.Portal.Insert(ctx, dbPortal))
+	cs := newTestChatServer(t)
+	client := &BlueskyClient{
+		Main:    connector,
+		ChatRPC: &xrpc.Client{Client: cs.srv.Client(), Host: cs.srv.URL},
+	}
+	return client, &bridgev2.Portal{Portal: dbPortal}, cs
+}
+
+func makeTestMatrixMessage(portal *bridgev2.Portal, content *event.MessageEventContent, origSender *bridgev2.OrigSender) *bridgev2.MatrixMessage {
+	return &bridgev2.MatrixMessage{
+		MatrixEventBase: bridgev2.MatrixEventBase[*event.MessageEventContent]{
+			Event: &event.Event{
+				ID:     testEventID,
+				Sender: testMatrixUser,
+				RoomID: portal.MXID,
+				Type:   event.EventMessage,
+			},
+			Content:    content,
+			Portal:     portal,
+			OrigSender: origSender,
+		},
+	}
+}
+
+// saveTestResponse saves the response message the same way bridgev2 does after HandleMatrixMessage returns.
+func saveTestResponse(t *testing.T, b *BlueskyClient, msg *bridgev2.MatrixMessage, resp *bridgev2.MatrixMessageResponse) {
+	_, err := b.Main.Bridge.GetGhostByID(context.Background(), resp.DB.SenderID)
+	require.NoError(t, err)
+	resp.DB.Room = msg.Portal.PortalKey
+	resp.DB.MXID = msg.Event.ID
+	resp.DB.SenderMXID = msg.Event.Sender
+	require.NoError(t, b.Main.Bridge.DB.Message.Insert(context.Background(), resp.DB))
+}
+
+func TestHandleMatrixMessage_CaptionedMediaLink(t *testing.T) {
+	b, portal, cs := newTestClient(t)
+	ctx := context.Background()
+	msg := makeTestMatrixMessage(portal, &event.MessageEventContent{
+		MsgType:  event.MsgImage,
+		Body:     "look at this",
+		FileName: "cat.jpg",
+		URL:      "mxc://example.com/cat",
+	}, nil)
+	resp, err := b.HandleMatrixMessage(ctx, msg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"look at this", "📎 cat.jpg\n" + testPublicMedia + "example.com/cat"}, cs.getSent())
+	assert.Equal(t, makeMessageID(portal.ID, "msg1"), resp.DB.ID)
+	assert.True(t, resp.DB.Metadata.(*MessageMetadata).Split)
+	// The first part must still be saveable after the extra part was saved
+	saveTestResponse(t, b, msg, resp)
+
+	for _, remoteID := range []string{"msg1", "msg2"} {
+		part, err := b.Main.Bridge.DB.Message.GetFirstPartByID(ctx, portal.Receiver, makeMessageID(portal.ID, remoteID))
+		require.NoError(t, err)
+		require.NotNil(t, part, "message %s wasn't saved", remoteID)
+		assert.True(t, part.Metadata.(*MessageMetadata).Split)
+	}
+	extraPart, err := b.Main.Bridge.DB.Message.GetFirstPartByID(ctx, portal.Receiver, makeMessageID(portal.ID, "msg2"))
+	require.NoError(t, err)
+	assert.True(t, extraPart.HasFakeMXID())
+	// Reactions and redactions of the Matrix event must target the first part
+	byMXID, err := b.Main.Bridge.DB.Message.GetPartByMXID(ctx, testEventID)
+	require.NoError(t, err)
+	assert.Equal(t, resp.DB.ID, byMXID.ID)
+}
+
+func TestHandleMatrixMessage_SinglePart(t *testing.T) {
+	b, portal, cs := newTestClient(t)
+	msg := makeTestMatrixMessage(portal, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}, nil)
+	resp, err := b.HandleMatrixMessage(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hello"}, cs.getSent())
+	assert.Equal(t, makeMessageID(portal.ID, "msg1"), resp.DB.ID)
+	assert.False(t, resp.DB.Metadata.(*MessageMetadata).Split)
+	saveTestResponse(t, b, msg, resp)
+}
+
+var testOrigSender = &bridgev2.OrigSender{
+	UserID:            "@bob:example.com",
+	DisambiguatedName: "Bob",
+}
+
+func TestHandleMatrixMessage_RelayPrefix(t *testing.T) {
+	b, portal, cs := newTestClient(t)
+	msg := makeTestMatrixMessage(portal, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}, testOrigSender)
+	_, err := b.HandleMatrixMessage(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bob: hello"}, cs.getSent())
+}
+
+func TestHandleMatrixMessage_RelayPrefixUserIDFallback(t *testing.T) {
+	b, portal, cs := newTestClient(t)
+	origSender := &bridgev2.OrigSender{UserID: "@bob:example.com"}
+	msg := makeTestMatrixMessage(portal, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}, origSender)
+	_, err := b.HandleMatrixMessage(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"@bob:example.com: hello"}, cs.getSent())
+}
+
+func TestHandleMatrixMessage_RelayedEmote(t *testing.T) {
+	b, portal, cs := newTestClient(t)
+	msg := makeTestMatrixMessage(portal, &event.MessageEventContent{MsgType: event.MsgEmote, Body: "waves"}, testOrigSender)
+	_, err := b.HandleMatrixMessage(context.Background(), msg)
+	require.NoError(t, err)
+	// Emotes include the name already, so the relay prefix isn't added
+	assert.Equal(t, []string{"* Bob waves"}, cs.getSent())
+}
+
+func TestPrependText(t *testing.T) {
+	const link = "https://example.com/"
+	input := makeLinkMessage("📎 cat.jpg", link)
+	prependText(input, "Zoë: ")
+	assert.Equal(t, "Zoë: 📎 cat.jpg\n"+link, input.Text)
+	require.Len(t, input.Facets, 1)
+	index := input.Facets[0].Index
+	// Facet indexes are byte offsets, so the multi-byte characters in the prefix must be counted as bytes
+	assert.Equal(t, link, input.Text[index.ByteStart:index.ByteEnd])
+}
+
+func TestHandleMatrixMessageRemove(t *testing.T) {
+	b, portal, _ := newTestClient(t)
+	makeRemove := func(origSender *bridgev2.OrigSender) *bridgev2.MatrixMessageRemove {
+		return &bridgev2.MatrixMessageRemove{
+			MatrixEventBase: bridgev2.MatrixEventBase[*event.RedactionEventContent]{
+				Event:      &event.Event{ID: "$redaction", Sender: testMatrixUser, RoomID: portal.MXID, Type: event.EventRedaction},
+				Content:    &event.RedactionEventContent{Redacts: testEventID},
+				Portal:     portal,
+				OrigSender: origSender,
+			},
+			TargetMessage: &database.Message{ID: makeMessageID(portal.ID, "msg1")},
+		}
+	}
+	assert.Equal(t, errRelayedRedactionsNotSupported, b.HandleMatrixMessageRemove(context.Background(), makeRemove(testOrigSender)))
+	assert.Equal(t, bridgev2.ErrRedactionsNotSupported, b.HandleMatrixMessageRemove(context.Background(), makeRemove(nil)))
+}
@@ -19,9 +19,9 @@ package connector
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/syntax"
-	"github.com/whyrusleeping/go-did"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 )
@@ -34,28 +34,32 @@ func parseUserLoginID(id networkid.UserLoginID) string {
 	return string(id)
 }
 
+// Ghost IDs are the DID method and identifier separated by a hyphen, e.g. `plc-abcd` for `did:plc:abcd`.
+// DID methods can only contain lowercase letters, so the first hyphen is always the separator.
+// Colons in the identifier (e.g. did:web paths) are replaced with plus signs, which are never valid in DIDs,
+// so the encoding is reversible and ghost IDs never contain colons.
+func makeUserID(parsedDID syntax.DID) networkid.UserID {
+	return networkid.UserID(fmt.Sprintf("%s-%s", parsedDID.Method(), strings.ReplaceAll(parsedDID.Identifier(), ":", "+")))
+}
+
 func makeUserIDFromString(rawDID string) (networkid.UserID, error) {
-	parsedDID, err := did.ParseDID(rawDID)
+	parsedDID, err := syntax.ParseDID(rawDID)
 	if err != nil {
 		return "", err
 	}
 	return makeUserID(parsedDID), nil
 }
 
-func makeUserID(parsedDID did.DID) networkid.UserID {
-	return networkid.UserID(fmt.Sprintf("%s-%s", parsedDID.Protocol(), parsedDID.Value()))
-}
-
-//func makeUserID2(parsedDID syntax.DID) networkid.UserID {
-//	return networkid.UserID(fmt.Sprintf("%s-%s", parsedDID.Method(), parsedDID.Identifier()))
-//}
-
 func parseUserID(id networkid.UserID) syntax.DID {
-	parts := strings.SplitN(string(id), "-", 2)
-	if len(parts) != 2 {
+	method, identifier, ok := strings.Cut(string(id), "-")
+	if !ok || strings.Contains(identifier, ":") {
 		return ""
 	}
-	return syntax.DID(fmt.Sprintf("did:%s:%s", parts[0], parts[1]))
+	parsedDID, err := syntax.ParseDID(fmt.Sprintf("did:%s:%s", method, strings.ReplaceAll(identifier, "+", ":")))
+	if err != nil {
+		return ""
+	}
+	return parsedDID
 }
 
 func makePortalID(id string) networkid.PortalID {
@@ -78,6 +82,19 @@ func parseMessageID(id networkid.MessageID) (networkid.PortalID, string) {
 	return networkid.PortalID(parts[0]), parts[1]
 }
 
+// makeStreamOrder converts a TID-based rev into a stream order. TIDs are strictly ordered,
+// so they're better than message timestamps, which can collide and depend on the sender's clock.
+//
+// If the rev isn't a valid TID, the timestamp is converted into the same format instead (microseconds shifted
+// left by 10 bits, i.e. a TID with clock ID 0), so the same message always gets the same stream order.
+func makeStreamOrder(rev string, fallback time.Time) int64 {
+	tid, err := syntax.ParseTID(rev)
+	if err == nil {
+		return int64(tid.Integer())
+	}
+	return fallback.UnixMicro() << 10
+}
+
 func (b *BlueskyClient) makeEventSender(userDID string) (bridgev2.EventSender, error) {
 	userID, err := makeUserIDFromString(userDID)
 	if err != nil {
@@ -90,10 +107,11 @@ func (b *BlueskyClient) makeEventSender(userDID string) (bridgev2.EventSender, e
 	}, nil
 }
 
-func (b *BlueskyClient) makePortalKey(chatID string) networkid.PortalKey {
-	return networkid.PortalKey{
-		ID: makePortalID(chatID),
-		// Bluesky only supports DMs currently, so always use a receiver
-		Receiver: b.UserLogin.ID,
+func (b *BlueskyClient) makePortalKey(chatID string, isGroup bool) networkid.PortalKey {
+	key := networkid.PortalKey{ID: makePortalID(chatID)}
+	// Group chats are shared between all bridge users in them, unless split portals are enabled
+	if !isGroup || b.Main.Bridge.Config.SplitPortals {
+		key.Receiver = b.UserLogin.ID
 	}
+	return key
 }
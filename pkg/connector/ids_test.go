@@ -0,0 +1,99 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+var userIDTestCases = []struct {
+	did    string
+	userID networkid.UserID
+}{
+	{"did:plc:ewvi7nxzyoun6zhxrhs64oiz", "plc-ewvi7nxzyoun6zhxrhs64oiz"},
+	{"did:web:example.com", "web-example.com"},
+	{"did:web:my-site.example.com", "web-my-site.example.com"},
+	{"did:web:localhost%3A8080", "web-localhost%3A8080"},
+	{"did:web:example.com:users:alice", "web-example.com+users+alice"},
+	{"did:web:example.com%3A8443:u:a-b", "web-example.com%3A8443+u+a-b"},
+	{"did:example:a-b:c-d", "example-a-b+c-d"},
+}
+
+func TestMakeUserID(t *testing.T) {
+	for _, tc := range userIDTestCases {
+		t.Run(tc.did, func(t *testing.T) {
+			did, err := syntax.ParseDID(tc.did)
+			require.NoError(t, err)
+			assert.Equal(t, tc.userID, makeUserID(did))
+			assert.Equal(t, did, parseUserID(tc.userID))
+		})
+	}
+}
+
+func TestParseUserID_Invalid(t *testing.T) {
+	for _, id := range []networkid.UserID{"", "plc", "plc-", "-abc", "PLC-abc", "web-example.com:8080", "web-example.com+"} {
+		assert.Empty(t, parseUserID(id), "%q should not be a valid user ID", id)
+	}
+}
+
+func FuzzUserIDRoundTrip(f *testing.F) {
+	for _, tc := range userIDTestCases {
+		f.Add(tc.did)
+	}
+	f.Fuzz(func(t *testing.T, rawDID string) {
+		did, err := syntax.ParseDID(rawDID)
+		if err != nil {
+			t.Skip()
+		}
+		userID := makeUserID(did)
+		assert.NotContains(t, string(userID), ":")
+		assert.Equal(t, did, parseUserID(userID))
+	})
+}
+
+// FuzzParseUserID checks that every user ID which parses successfully is the canonical ID of its DID,
+// i.e. two different user IDs can never refer to the same DID.
+func FuzzParseUserID(f *testing.F) {
+	for _, tc := range userIDTestCases {
+		f.Add(string(tc.userID))
+	}
+	f.Fuzz(func(t *testing.T, rawID string) {
+		did := parseUserID(networkid.UserID(rawID))
+		if did == "" {
+			t.Skip()
+		}
+		assert.Equal(t, networkid.UserID(rawID), makeUserID(did))
+	})
+}
+
+func TestMakeStreamOrder(t *testing.T) {
+	ts := time.UnixMicro(1_700_000_000_123_456)
+	tid := syntax.NewTIDFromTime(ts, 5)
+	assert.Equal(t, int64(tid.Integer()), makeStreamOrder(tid.String(), time.Time{}))
+
+	fallback := makeStreamOrder("not a tid", ts)
+	assert.Equal(t, int64(syntax.NewTIDFromTime(ts, 0).Integer()), fallback)
+	assert.Equal(t, fallback, makeStreamOrder("", ts), "fallback should only depend on the timestamp")
+	assert.Less(t, makeStreamOrder("", ts.Add(-time.Microsecond)), fallback)
+	assert.Less(t, fallback, int64(tid.Integer()))
+}
@@ -19,42 +19,67 @@ package connector
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/chat"
 	"github.com/bluesky-social/indigo/atproto/identity"
-	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/ptr"
-	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/status"
 )
 
-var loginFlows = []bridgev2.LoginFlow{{
+var passwordLoginFlow = bridgev2.LoginFlow{
 	Name:        "Username & password",
 	Description: "Log in by entering your Bluesky username and password",
 	ID:          "password",
-}}
+}
+
+var oauthLoginFlow = bridgev2.LoginFlow{
+	Name:        "OAuth",
+	Description: "Log in by approving the bridge in your browser",
+	ID:          "oauth",
+}
 
 func (b *BlueskyConnector) GetLoginFlows() []bridgev2.LoginFlow {
-	return loginFlows
+	if b.OAuth == nil {
+		return []bridgev2.LoginFlow{passwordLoginFlow}
+	}
+	return []bridgev2.LoginFlow{passwordLoginFlow, oauthLoginFlow}
 }
 
 func (b *BlueskyConnector) CreateLogin(ctx context.Context, user *bridgev2.User, flowID string) (bridgev2.LoginProcess, error) {
-	if flowID != "password" {
+	switch flowID {
+	case passwordLoginFlow.ID:
+		return &PasswordLogin{User: user, Main: b}, nil
+	case oauthLoginFlow.ID:
+		if b.OAuth == nil {
+			return nil, bridgev2.ErrInvalidLoginFlowID
+		}
+		return &OAuthLogin{User: user, Main: b}, nil
+	default:
 		return nil, bridgev2.ErrInvalidLoginFlowID
 	}
-	return &PasswordLogin{User: user}, nil
 }
 
 type PasswordLogin struct {
 	User *bridgev2.User
+	Main *BlueskyConnector
+
+	// The inputs of the first step are stored here if the server asks for an email 2FA code
+	input map[string]string
 }
 
-var _ bridgev2.LoginProcessUserInput = (*PasswordLogin)(nil)
+var (
+	_ bridgev2.LoginProcessUserInput    = (*PasswordLogin)(nil)
+	_ bridgev2.LoginProcessWithOverride = (*PasswordLogin)(nil)
+)
 
 func (p *PasswordLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
 	return &bridgev2.LoginStep{
@@ -63,15 +88,16 @@ func (p *PasswordLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error)
 		Instructions: "",
 		UserInputParams: &bridgev2.LoginUserInputParams{
 			Fields: []bridgev2.LoginInputDataField{{
-				Type:        bridgev2.LoginInputFieldTypeDomain,
-				ID:          "domain",
-				Name:        "Server",
-				Description: "Bluesky server. The default server is `bsky.social`",
-			}, {
 				Type:        bridgev2.LoginInputFieldTypeUsername,
 				ID:          "username",
 				Name:        "Username or email",
 				Description: "Bluesky account handle or email address",
+			}, {
+				Type:         bridgev2.LoginInputFieldTypeDomain,
+				ID:           "domain",
+				Name:         "Server",
+				Description:  "Server to log in to. Only used when logging in with an email address, handles are resolved automatically",
+				DefaultValue: "bsky.social",
 			}, {
 				Type:        bridgev2.LoginInputFieldTypePassword,
 				ID:          "password",
@@ -82,6 +108,15 @@ func (p *PasswordLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error)
 	}, nil
 }
 
+func (p *PasswordLogin) StartWithOverride(ctx context.Context, override *bridgev2.UserLogin) (*bridgev2.LoginStep, error) {
+	step, err := p.Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	step.UserInputParams.Fields[0].DefaultValue = override.RemoteName
+	return step, nil
+}
+
 func (p *PasswordLogin) Cancel() {}
 
 func parseDIDDoc(doc *any) (*identity.Identity, error) {
@@ -98,18 +133,120 @@ func parseDIDDoc(doc *any) (*identity.Identity, error) {
 	return &ident, nil
 }
 
+func isXRPCError(err error, code string) bool {
+	var xe *xrpc.XRPCError
+	return errors.As(err, &xe) && xe.ErrStr == code
+}
+
+const noChatAccessMessage = "The app password doesn't allow access to direct messages. " +
+	"Create a new app password with \"Allow access to your direct messages\" enabled and log in again."
+
+var errNoChatAccess = errors.New(noChatAccessMessage)
+
+// isChatAccessDenied checks if the error is caused by the session not having access to the chat service,
+// which happens when using an app password that isn't allowed to access direct messages.
+func isChatAccessDenied(err error) bool {
+	var xe *xrpc.XRPCError
+	if !errors.As(err, &xe) {
+		return false
+	}
+	return xe.ErrStr == "ScopeMissingError" ||
+		(xe.ErrStr == "InvalidToken" && strings.Contains(strings.ToLower(xe.Message), "scope"))
+}
+
+// checkChatAccess makes a cheap request to the chat service to make sure the session is allowed to use it.
+func checkChatAccess(ctx context.Context, chatRPC *xrpc.Client) error {
+	_, err := chat.ConvoListConvos(ctx, chatRPC, "", 1, "", "")
+	if isChatAccessDenied(err) {
+		return errNoChatAccess
+	} else if err != nil {
+		return fmt.Errorf("failed to check chat access: %w", err)
+	}
+	return nil
+}
+
+// getLoginChatService returns the chat service that a login for the given DID will use, so that the chat access
+// check during login uses the same service as the login itself. Relogins keep the existing per-login override
+// (see UserLoginMetadata.CopyFrom), while logins that replace another user's login start from the config.
+func (b *BlueskyConnector) getLoginChatService(user *bridgev2.User, did string) (string, error) {
+	meta := &UserLoginMetadata{}
+	if existing := b.Bridge.GetCachedUserLoginByID(makeUserLoginID(did)); existing != nil && existing.UserMXID == user.MXID {
+		meta = existing.Metadata.(*UserLoginMetadata)
+	}
+	chatService, _, err := b.getServices(meta)
+	return chatService, err
+}
+
+// resolveHost finds the server to log in to. Handles and DIDs are resolved to the PDS directly,
+// while email addresses can only be used with the entryway server provided by the user.
+func (p *PasswordLogin) resolveHost(ctx context.Context, identifier, domain string) (string, error) {
+	if strings.Contains(identifier, "@") {
+		domain = strings.TrimSpace(domain)
+		if domain == "" {
+			domain = "bsky.social"
+		}
+		if !strings.HasPrefix(domain, "https://") && !strings.HasPrefix(domain, "http://") {
+			domain = fmt.Sprintf("https://%s", domain)
+		}
+		return strings.TrimRight(domain, "/"), nil
+	}
+	atid, err := syntax.ParseAtIdentifier(identifier)
+	if err != nil {
+		return "", fmt.Errorf("invalid handle: %w", err)
+	}
+	ident, err := p.Main.Directory.Lookup(ctx, atid)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", identifier, err)
+	}
+	pdsEndpoint := ident.PDSEndpoint()
+	if pdsEndpoint == "" {
+		return "", fmt.Errorf("%s doesn't have a PDS", identifier)
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("identifier", identifier).
+		Str("did", ident.DID.String()).
+		Str("pds", pdsEndpoint).
+		Msg("Resolved PDS for login")
+	return pdsEndpoint, nil
+}
+
 func (p *PasswordLogin) SubmitUserInput(ctx context.Context, input map[string]string) (*bridgev2.LoginStep, error) {
+	var authFactorToken *string
+	if p.input != nil {
+		authFactorToken = ptr.Ptr(strings.TrimSpace(input["code"]))
+		input = p.input
+	}
+	identifier := strings.TrimPrefix(strings.TrimSpace(input["username"]), "@")
+	host, err := p.resolveHost(ctx, identifier, input["domain"])
+	if err != nil {
+		return nil, err
+	}
 	cli := &xrpc.Client{
-		Client:    util.RobustHTTPClient(),
-		Host:      fmt.Sprintf("https://%s", input["domain"]),
-		UserAgent: &mautrix.DefaultUserAgent,
+		Client:    p.Main.HTTPClient,
+		Host:      host,
+		UserAgent: &p.Main.UserAgent,
 	}
 	resp, err := atproto.ServerCreateSession(ctx, cli, &atproto.ServerCreateSession_Input{
-		AuthFactorToken: nil,
-		Identifier:      input["username"],
+		AuthFactorToken: authFactorToken,
+		Identifier:      identifier,
 		Password:        input["password"],
 	})
-	if err != nil {
+	if authFactorToken == nil && isXRPCError(err, "AuthFactorTokenRequired") {
+		p.input = input
+		return &bridgev2.LoginStep{
+			Type:         bridgev2.LoginStepTypeUserInput,
+			StepID:       "fi.mau.bluesky.email_2fa",
+			Instructions: "A sign in code has been sent to your email address",
+			UserInputParams: &bridgev2.LoginUserInputParams{
+				Fields: []bridgev2.LoginInputDataField{{
+					Type:        bridgev2.LoginInputFieldType2FACode,
+					ID:          "code",
+					Name:        "Code",
+					Description: "Sign in code from the email, in the format `XXXXX-XXXXX`",
+				}},
+			},
+		}, nil
+	} else if err != nil {
 		return nil, fmt.Errorf("failed to create session: %w", err)
 	}
 	ident, err := parseDIDDoc(resp.DidDoc)
@@ -122,7 +259,33 @@ func (p *PasswordLogin) SubmitUserInput(ctx context.Context, input map[string]st
 	} else {
 		zerolog.Ctx(ctx).Debug().Str("new_pds", pdsEndpoint).Msg("Login response contained PDS endpoint")
 	}
-	ul, err := p.User.NewLogin(ctx, &database.UserLogin{
+	chatService, err := p.Main.getLoginChatService(p.User, resp.Did)
+	if err != nil {
+		return nil, err
+	}
+	err = checkChatAccess(ctx, &xrpc.Client{
+		Client:    cli.Client,
+		Host:      pdsEndpoint,
+		Auth:      &xrpc.AuthInfo{AccessJwt: resp.AccessJwt},
+		UserAgent: cli.UserAgent,
+		Headers:   proxyHeaders(chatService),
+	})
+	if err != nil {
+		if errors.Is(err, errNoChatAccess) {
+			err = atproto.ServerDeleteSession(ctx, &xrpc.Client{
+				Client:    cli.Client,
+				Host:      pdsEndpoint,
+				Auth:      &xrpc.AuthInfo{AccessJwt: resp.RefreshJwt},
+				UserAgent: cli.UserAgent,
+			})
+			if err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to delete session after chat access check failed")
+			}
+			return nil, errNoChatAccess
+		}
+		return nil, err
+	}
+	return completeLogin(ctx, p.User, &database.UserLogin{
 		ID:         makeUserLoginID(resp.Did),
 		RemoteName: resp.Handle,
 		RemoteProfile: status.RemoteProfile{
@@ -138,25 +301,41 @@ func (p *PasswordLogin) SubmitUserInput(ctx context.Context, input map[string]st
 				Did:        resp.Did,
 			},
 		},
-	}, &bridgev2.NewLoginParams{
+	})
+}
+
+func completeLogin(ctx context.Context, user *bridgev2.User, dbLogin *database.UserLogin) (*bridgev2.LoginStep, error) {
+	existing := user.Bridge.GetCachedUserLoginByID(dbLogin.ID)
+	isRelogin := existing != nil && existing.UserMXID == user.MXID
+	if isRelogin && existing.Client != nil {
+		// NewLogin will reuse the existing login and replace the client, so stop the old one first.
+		// The metadata is merged in UserLoginMetadata.CopyFrom, which keeps the log cursor.
+		existing.Client.Disconnect()
+	}
+	ul, err := user.NewLogin(ctx, dbLogin, &bridgev2.NewLoginParams{
 		DeleteOnConflict: true,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to save new login: %w", err)
 	}
 	ul.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting})
-	go func(ctx context.Context) {
-		bc := ul.Client.(*BlueskyClient)
-		err = bc.fetchInbox(ctx)
-		if err != nil {
-			zerolog.Ctx(ctx).Err(err).Msg("Failed to fetch inbox after login")
-		}
-		bc.startPolling()
-	}(context.WithoutCancel(ctx))
+	bc := ul.Client.(*BlueskyClient)
+	if isRelogin {
+		zerolog.Ctx(ctx).Debug().Str("login_id", string(ul.ID)).Msg("Resuming polling after relogin")
+		go bc.startPolling()
+	} else {
+		go func(ctx context.Context) {
+			err := bc.fetchInbox(ctx)
+			if err != nil {
+				zerolog.Ctx(ctx).Err(err).Msg("Failed to fetch inbox after login")
+			}
+			bc.startPolling()
+		}(context.WithoutCancel(ctx))
+	}
 	return &bridgev2.LoginStep{
 		Type:         bridgev2.LoginStepTypeComplete,
 		StepID:       "fi.mau.bluesky.complete",
-		Instructions: fmt.Sprintf("Successfully logged in as %s", resp.Handle),
+		Instructions: fmt.Sprintf("Successfully logged in as %s", ul.RemoteName),
 		CompleteParams: &bridgev2.LoginCompleteParams{
 			UserLoginID: ul.ID,
 			UserLogin:   ul,
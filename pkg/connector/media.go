@@ -0,0 +1,234 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMaxMediaSize = 50 * 1024 * 1024
+	// mediaCacheSize is the maximum number of responses the fetcher remembers for conditional requests.
+	mediaCacheSize = 256
+	// maxCachedMediaSize is the maximum size of a single response that will be cached.
+	maxCachedMediaSize = 1024 * 1024
+)
+
+var (
+	ErrMediaNotFound    = errors.New("media not found")
+	ErrMediaBadStatus   = errors.New("unexpected HTTP status")
+	ErrMediaTooLarge    = errors.New("media is too large")
+	ErrMediaInvalidType = errors.New("unexpected media type")
+)
+
+// MediaFetcher downloads media (e.g. avatars) from the Bluesky CDN
+// and validates the response before it's passed on to Matrix.
+type MediaFetcher struct {
+	Client    *http.Client
+	UserAgent string
+	MaxSize   int64
+
+	cache      map[string]*FetchedMedia
+	cacheOrder []string
+	cacheLock  sync.Mutex
+}
+
+type MediaRequest struct {
+	URL string
+	// AllowedTypes is a list of allowed mime types. Entries ending with a slash are treated as prefixes (e.g. `image/`).
+	AllowedTypes []string
+	// PreferThumbnail will make the fetcher download the thumbnail variant of CDN URLs when one exists.
+	PreferThumbnail bool
+
+	// ETag and LastModified are used for conditional requests. If the server says the media hasn't changed,
+	// the response will have NotModified set and no data. If they're not set, the validators of a previously
+	// cached response for the same URL are used instead, and the cached data is returned if it hasn't changed.
+	ETag         string
+	LastModified string
+}
+
+type FetchedMedia struct {
+	Data     []byte
+	MimeType string
+
+	ETag         string
+	LastModified string
+	NotModified  bool
+}
+
+// cdnThumbnailVariants maps full size Bluesky CDN image presets to their smaller variants.
+var cdnThumbnailVariants = map[string]string{
+	"avatar":        "avatar_thumbnail",
+	"feed_fullsize": "feed_thumbnail",
+}
+
+// thumbnailURL returns the thumbnail variant of a Bluesky CDN image URL,
+// e.g. https://cdn.bsky.app/img/avatar/plain/<did>/<cid>@jpeg -> .../img/avatar_thumbnail/plain/...
+func thumbnailURL(url string) string {
+	for full, thumb := range cdnThumbnailVariants {
+		if strings.HasPrefix(url, "https://cdn.bsky.app/img/"+full+"/") {
+			return strings.Replace(url, "/img/"+full+"/", "/img/"+thumb+"/", 1)
+		}
+	}
+	return url
+}
+
+func isAllowedType(mimeType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, allowedType := range allowed {
+		if strings.HasSuffix(allowedType, "/") && strings.HasPrefix(mimeType, allowedType) {
+			return true
+		} else if mimeType == allowedType {
+			return true
+		}
+	}
+	return false
+}
+
+func (mf *MediaFetcher) Fetch(ctx context.Context, params *MediaRequest) (*FetchedMedia, error) {
+	url := params.URL
+	if params.PreferThumbnail {
+		url = thumbnailURL(url)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("User-Agent", mf.UserAgent)
+	etag, lastModified := params.ETag, params.LastModified
+	var cached *FetchedMedia
+	if etag == "" && lastModified == "" {
+		cached = mf.getCached(url)
+		if cached != nil {
+			etag, lastModified = cached.ETag, cached.LastModified
+		}
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := mf.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return &FetchedMedia{
+			Data:         cached.Data,
+			MimeType:     cached.MimeType,
+			ETag:         cached.ETag,
+			LastModified: cached.LastModified,
+			NotModified:  true,
+		}, nil
+	case resp.StatusCode == http.StatusNotModified:
+		return &FetchedMedia{
+			ETag:         etag,
+			LastModified: lastModified,
+			NotModified:  true,
+		}, nil
+	case resp.StatusCode == http.StatusNotFound:
+		mf.removeCached(url)
+		return nil, ErrMediaNotFound
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("%w %d", ErrMediaBadStatus, resp.StatusCode)
+	}
+	maxSize := mf.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxMediaSize
+	}
+	if resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("%w (%d bytes)", ErrMediaTooLarge, resp.ContentLength)
+	}
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mimeType != "" && mimeType != "application/octet-stream" && !isAllowedType(mimeType, params.AllowedTypes) {
+		return nil, fmt.Errorf("%w %s", ErrMediaInvalidType, mimeType)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	} else if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w (over %d bytes)", ErrMediaTooLarge, maxSize)
+	}
+	// The CDN should always send a proper content type, but check the data itself too just in case
+	detectedType := http.DetectContentType(data)
+	if !isAllowedType(detectedType, params.AllowedTypes) {
+		return nil, fmt.Errorf("%w %s", ErrMediaInvalidType, detectedType)
+	}
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = detectedType
+	}
+	fetched := &FetchedMedia{
+		Data:         data,
+		MimeType:     mimeType,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	mf.putCached(url, fetched)
+	return fetched, nil
+}
+
+func (mf *MediaFetcher) getCached(url string) *FetchedMedia {
+	mf.cacheLock.Lock()
+	defer mf.cacheLock.Unlock()
+	return mf.cache[url]
+}
+
+func (mf *MediaFetcher) removeCached(url string) {
+	mf.cacheLock.Lock()
+	defer mf.cacheLock.Unlock()
+	if _, exists := mf.cache[url]; exists {
+		delete(mf.cache, url)
+		mf.cacheOrder = slices.DeleteFunc(mf.cacheOrder, func(cachedURL string) bool {
+			return cachedURL == url
+		})
+	}
+}
+
+// putCached remembers the response for future conditional requests. Responses without validators
+// and large responses aren't cached. The oldest entries are evicted once the cache is full.
+func (mf *MediaFetcher) putCached(url string, media *FetchedMedia) {
+	if (media.ETag == "" && media.LastModified == "") || len(media.Data) > maxCachedMediaSize {
+		mf.removeCached(url)
+		return
+	}
+	mf.cacheLock.Lock()
+	defer mf.cacheLock.Unlock()
+	if mf.cache == nil {
+		mf.cache = make(map[string]*FetchedMedia)
+	}
+	if _, exists := mf.cache[url]; !exists {
+		mf.cacheOrder = append(mf.cacheOrder, url)
+	}
+	mf.cache[url] = media
+	for len(mf.cache) > mediaCacheSize && len(mf.cacheOrder) > 0 {
+		delete(mf.cache, mf.cacheOrder[0])
+		mf.cacheOrder = mf.cacheOrder[1:]
+	}
+}
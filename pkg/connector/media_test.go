@@ -0,0 +1,83 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPNG is the 8-byte PNG signature, which is enough for http.DetectContentType.
+var testPNG = []byte("\x89PNG\r\n\x1a\n")
+
+const testETag = `"avatar-v1"`
+
+func newTestMediaServer(t *testing.T, requests *[]*http.Request) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r)
+		if r.Header.Get("If-None-Match") == testETag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", testETag)
+		_, _ = w.Write(testPNG)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMediaFetcher_Fetch_CachedConditional(t *testing.T) {
+	var requests []*http.Request
+	srv := newTestMediaServer(t, &requests)
+	mf := &MediaFetcher{Client: srv.Client()}
+	params := &MediaRequest{URL: srv.URL + "/avatar", AllowedTypes: []string{"image/"}}
+
+	first, err := mf.Fetch(context.Background(), params)
+	require.NoError(t, err)
+	assert.False(t, first.NotModified)
+	assert.Equal(t, testPNG, first.Data)
+	assert.Equal(t, testETag, first.ETag)
+
+	second, err := mf.Fetch(context.Background(), params)
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+	assert.Empty(t, requests[0].Header.Get("If-None-Match"))
+	assert.Equal(t, testETag, requests[1].Header.Get("If-None-Match"))
+	assert.True(t, second.NotModified)
+	assert.Equal(t, testPNG, second.Data)
+	assert.Equal(t, "image/png", second.MimeType)
+}
+
+func TestMediaFetcher_Fetch_ExplicitConditional(t *testing.T) {
+	var requests []*http.Request
+	srv := newTestMediaServer(t, &requests)
+	mf := &MediaFetcher{Client: srv.Client()}
+
+	resp, err := mf.Fetch(context.Background(), &MediaRequest{URL: srv.URL + "/avatar", ETag: testETag})
+	require.NoError(t, err)
+	require.Len(t, requests, 1)
+	assert.Equal(t, testETag, requests[0].Header.Get("If-None-Match"))
+	assert.True(t, resp.NotModified)
+	assert.Empty(t, resp.Data)
+	assert.Equal(t, testETag, resp.ETag)
+}
@@ -0,0 +1,169 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	kvGhostIDVersion      database.Key = "bluesky_ghost_id_version"
+	currentGhostIDVersion              = "2"
+)
+
+// migrateGhostIDs converts ghost IDs from the old format, which had colons in did:web identifiers as-is,
+// to the current one. Messages, reactions and other rows referencing ghosts are updated by the foreign keys.
+//
+// The Matrix user IDs of affected ghosts change too, so the old ghosts are moved out of existing rooms
+// and replaced with the new ones, see replaceMigratedGhosts.
+func (b *BlueskyConnector) migrateGhostIDs(ctx context.Context) error {
+	db := b.Bridge.DB
+	if db.KV.Get(ctx, kvGhostIDVersion) == currentGhostIDVersion {
+		return nil
+	}
+	log := zerolog.Ctx(ctx).With().Str("action", "migrate ghost IDs").Logger()
+	rows, err := db.Query(ctx, "SELECT id FROM ghost WHERE bridge_id=$1 AND id LIKE '%:%'", db.BridgeID)
+	oldIDs, err := dbutil.NewRowIterWithError(rows, dbutil.ScanSingleColumn[networkid.UserID], err).AsList()
+	if err != nil {
+		return fmt.Errorf("failed to get ghosts to migrate: %w", err)
+	}
+	migrated := make(map[networkid.UserID]networkid.UserID, len(oldIDs))
+	err = db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, oldID := range oldIDs {
+			newID, err := makeUserIDFromString("did:" + strings.Replace(string(oldID), "-", ":", 1))
+			if err != nil {
+				log.Warn().Err(err).Str("ghost_id", string(oldID)).Msg("Failed to parse old ghost ID, skipping migration")
+				continue
+			}
+			// The profile of the new Matrix user hasn't been set, so clear the flags to make the bridge set it again
+			_, err = db.Exec(ctx, `
+				UPDATE ghost SET id=$3, name_set=false, avatar_set=false, contact_info_set=false
+				WHERE bridge_id=$1 AND id=$2
+			`, db.BridgeID, oldID, newID)
+			if err != nil {
+				return fmt.Errorf("failed to update ghost %s: %w", oldID, err)
+			}
+			_, err = db.Exec(ctx, "UPDATE portal SET other_user_id=$3 WHERE bridge_id=$1 AND other_user_id=$2", db.BridgeID, oldID, newID)
+			if err != nil {
+				return fmt.Errorf("failed to update portals with ghost %s: %w", oldID, err)
+			}
+			migrated[oldID] = newID
+			log.Debug().Str("old_id", string(oldID)).Str("new_id", string(newID)).Msg("Migrated ghost ID")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(migrated) > 0 {
+		b.replaceMigratedGhosts(log.WithContext(ctx), migrated)
+	}
+	db.KV.Set(ctx, kvGhostIDVersion, currentGhostIDVersion)
+	log.Info().Int("ghost_count", len(migrated)).Msg("Migrated ghost IDs")
+	return nil
+}
+
+// replaceMigratedGhosts makes the old Matrix users of migrated ghosts leave all portal rooms they're in,
+// and invites and joins the new Matrix users in their place. Failures are only logged, as the new ghosts
+// will be added to rooms anyway the next time the member list is synced.
+func (b *BlueskyConnector) replaceMigratedGhosts(ctx context.Context, migrated map[networkid.UserID]networkid.UserID) {
+	log := zerolog.Ctx(ctx)
+	portals, err := b.Bridge.GetAllPortalsWithMXID(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to get portals to replace migrated ghosts in")
+		return
+	}
+	for _, portal := range portals {
+		members, err := b.Bridge.Matrix.GetMembers(ctx, portal.MXID)
+		if err != nil {
+			log.Warn().Err(err).Stringer("room_id", portal.MXID).Msg("Failed to get room members to replace migrated ghosts")
+			continue
+		}
+		for oldID, newID := range migrated {
+			oldIntent := b.Bridge.Matrix.GhostIntent(oldID)
+			member, ok := members[oldIntent.GetMXID()]
+			if !ok || member.Membership != event.MembershipJoin {
+				continue
+			}
+			newIntent := b.Bridge.Matrix.GhostIntent(newID)
+			log := log.With().
+				Stringer("room_id", portal.MXID).
+				Stringer("old_mxid", oldIntent.GetMXID()).
+				Stringer("new_mxid", newIntent.GetMXID()).
+				Logger()
+			err = b.Bridge.Bot.EnsureInvited(ctx, portal.MXID, newIntent.GetMXID())
+			if err == nil {
+				err = newIntent.EnsureJoined(ctx, portal.MXID)
+			}
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to add new ghost to room")
+			}
+			_, err = oldIntent.SendState(ctx, portal.MXID, event.StateMember, oldIntent.GetMXID().String(), &event.Content{
+				Parsed: &event.MemberEventContent{Membership: event.MembershipLeave},
+			}, time.Time{})
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to remove old ghost from room")
+			} else {
+				log.Debug().Msg("Replaced migrated ghost in room")
+			}
+		}
+	}
+}
+
+// migrateGroupPortalKeys moves group portals that were created with a receiver to the shared portal key
+// used when split portals are disabled. Otherwise the old portals are never found again and a duplicate
+// room is created for each group. Portals of the same group from different logins are merged by ReIDPortal.
+//
+// This runs on every startup rather than once, as the split_portals option may be disabled at any time.
+func (b *BlueskyConnector) migrateGroupPortalKeys(ctx context.Context) error {
+	if b.Bridge.Config.SplitPortals {
+		return nil
+	}
+	db := b.Bridge.DB
+	log := zerolog.Ctx(ctx).With().Str("action", "migrate group portal keys").Logger()
+	rows, err := db.Query(ctx, `
+		SELECT id, receiver FROM portal
+		WHERE bridge_id=$1 AND receiver<>'' AND room_type<>$2
+	`, db.BridgeID, database.RoomTypeDM)
+	oldKeys, err := dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (key networkid.PortalKey, err error) {
+		err = row.Scan(&key.ID, &key.Receiver)
+		return
+	}, err).AsList()
+	if err != nil {
+		return fmt.Errorf("failed to get group portals to migrate: %w", err)
+	}
+	for _, oldKey := range oldKeys {
+		result, _, err := b.Bridge.ReIDPortal(log.WithContext(ctx), oldKey, networkid.PortalKey{ID: oldKey.ID})
+		if err != nil {
+			return fmt.Errorf("failed to migrate group portal %s: %w", oldKey, err)
+		}
+		log.Debug().Stringer("portal_key", oldKey).Int("result", int(result)).Msg("Migrated group portal key")
+	}
+	if len(oldKeys) > 0 {
+		log.Info().Int("portal_count", len(oldKeys)).Msg("Migrated group portal keys")
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+	"go.mau.fi/util/exsync"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/status"
+)
+
+const (
+	oauthClientMetadataPath = "/_bluesky/oauth/client-metadata.json"
+	oauthCallbackPath       = "/_bluesky/oauth/callback"
+)
+
+// oauthLoginTimeout is how long Wait waits for the user to approve the login. It's a variable for tests.
+var oauthLoginTimeout = 10 * time.Minute
+
+var oauthScopes = []string{"atproto", "transition:generic", "transition:chat.bsky"}
+
+// initOAuth sets up the OAuth client app and registers the client metadata and callback endpoints.
+// OAuth requires the bridge to be reachable from the internet, so it's only enabled if the public address is set.
+func (b *BlueskyConnector) initOAuth() {
+	mcs, ok := b.Bridge.Matrix.(bridgev2.MatrixConnectorWithServer)
+	if !ok || mcs.GetPublicAddress() == "" || mcs.GetRouter() == nil {
+		return
+	}
+	b.setupOAuth(mcs.GetPublicAddress())
+	router := mcs.GetRouter()
+	router.HandleFunc("GET "+oauthClientMetadataPath, b.serveOAuthClientMetadata)
+	router.HandleFunc("GET "+oauthCallbackPath, b.serveOAuthCallback)
+}
+
+// setupOAuth creates the OAuth client app for a bridge reachable at the given public address.
+func (b *BlueskyConnector) setupOAuth(publicAddress string) {
+	config := oauth.NewPublicConfig(publicAddress+oauthClientMetadataPath, publicAddress+oauthCallbackPath, oauthScopes)
+	config.UserAgent = b.UserAgent
+	b.oauthCallbacks = exsync.NewMap[string, chan url.Values]()
+	b.OAuth = oauth.NewClientApp(&config, &oauthStore{requests: exsync.NewMap[string, oauth.AuthRequestData]()})
+	b.OAuth.Client = b.HTTPClient
+	b.OAuth.Resolver.Client = b.HTTPClient
+	b.OAuth.Dir = b.Directory
+}
+
+func (b *BlueskyConnector) serveOAuthClientMetadata(w http.ResponseWriter, r *http.Request) {
+	meta := b.OAuth.Config.ClientMetadata()
+	meta.ClientName = ptr.Ptr(fmt.Sprintf("%s bridge", b.GetName().DisplayName))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(meta)
+}
+
+func (b *BlueskyConnector) serveOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ch, ok := b.oauthCallbacks.Pop(query.Get("state"))
+	if !ok {
+		http.Error(w, "Unknown or expired login. Please restart the login process.", http.StatusNotFound)
+		return
+	}
+	ch <- query
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("Login approved, you can now close this page and return to Matrix."))
+}
+
+// oauthStore keeps pending auth requests in memory. Sessions are stored in the user login metadata
+// instead of the store, so the session methods don't do anything.
+type oauthStore struct {
+	requests *exsync.Map[string, oauth.AuthRequestData]
+}
+
+var _ oauth.ClientAuthStore = (*oauthStore)(nil)
+
+func (o *oauthStore) GetSession(ctx context.Context, did syntax.DID, sessionID string) (*oauth.ClientSessionData, error) {
+	return nil, fmt.Errorf("OAuth sessions are not stored in the auth store")
+}
+
+func (o *oauthStore) SaveSession(ctx context.Context, sess oauth.ClientSessionData) error {
+	return nil
+}
+
+func (o *oauthStore) DeleteSession(ctx context.Context, did syntax.DID, sessionID string) error {
+	return nil
+}
+
+func (o *oauthStore) GetAuthRequestInfo(ctx context.Context, state string) (*oauth.AuthRequestData, error) {
+	info, ok := o.requests.Get(state)
+	if !ok {
+		return nil, fmt.Errorf("auth request not found")
+	}
+	return &info, nil
+}
+
+func (o *oauthStore) SaveAuthRequestInfo(ctx context.Context, info oauth.AuthRequestData) error {
+	o.requests.Set(info.State, info)
+	return nil
+}
+
+func (o *oauthStore) DeleteAuthRequestInfo(ctx context.Context, state string) error {
+	o.requests.Delete(state)
+	return nil
+}
+
+// newOAuthSession creates an OAuth session from stored session data. The session updates tokens and
+// DPoP nonces in the given data struct and calls the persist callback afterwards.
+func (b *BlueskyConnector) newOAuthSession(data *oauth.ClientSessionData, persist oauth.PersistSessionCallback) (*oauth.ClientSession, error) {
+	if b.OAuth == nil {
+		return nil, fmt.Errorf("OAuth logins require the bridge public address to be configured")
+	}
+	priv, err := atcrypto.ParsePrivateMultibase(data.DPoPPrivateKeyMultibase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DPoP private key: %w", err)
+	}
+	return &oauth.ClientSession{
+		Client:                 b.OAuth.Client,
+		Config:                 b.OAuth.Config,
+		Data:                   data,
+		DPoPPrivateKey:         priv,
+		PersistSessionCallback: persist,
+	}, nil
+}
+
+// oauthTransport is a http.RoundTripper that signs requests with the DPoP key of an OAuth session.
+// The session takes care of DPoP nonce updates and refreshing expired access tokens.
+type oauthTransport struct {
+	Session *oauth.ClientSession
+	Client  *http.Client
+}
+
+func (ot *oauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint, _ := syntax.ParseNSID(strings.TrimPrefix(req.URL.Path, "/xrpc/"))
+	return ot.Session.DoWithAuth(ot.Client, req.Clone(req.Context()), endpoint)
+}
+
+type OAuthLogin struct {
+	User *bridgev2.User
+	Main *BlueskyConnector
+
+	state    string
+	callback chan url.Values
+}
+
+var (
+	_ bridgev2.LoginProcessUserInput      = (*OAuthLogin)(nil)
+	_ bridgev2.LoginProcessDisplayAndWait = (*OAuthLogin)(nil)
+	_ bridgev2.LoginProcessWithOverride   = (*OAuthLogin)(nil)
+)
+
+func (o *OAuthLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
+	return &bridgev2.LoginStep{
+		Type:         bridgev2.LoginStepTypeUserInput,
+		StepID:       "fi.mau.bluesky.oauth.identifier",
+		Instructions: "",
+		UserInputParams: &bridgev2.LoginUserInputParams{
+			Fields: []bridgev2.LoginInputDataField{{
+				Type:        bridgev2.LoginInputFieldTypeUsername,
+				ID:          "identifier",
+				Name:        "Handle",
+				Description: "Bluesky account handle or DID, or the https:// URL of your authorization server",
+			}},
+		},
+	}, nil
+}
+
+func (o *OAuthLogin) StartWithOverride(ctx context.Context, override *bridgev2.UserLogin) (*bridgev2.LoginStep, error) {
+	step, err := o.Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	step.UserInputParams.Fields[0].DefaultValue = override.RemoteName
+	return step, nil
+}
+
+func (o *OAuthLogin) Cancel() {
+	if o.state != "" {
+		o.Main.oauthCallbacks.Delete(o.state)
+		_ = o.Main.OAuth.Store.DeleteAuthRequestInfo(context.Background(), o.state)
+	}
+}
+
+// startAuthFlow is equivalent to [oauth.ClientApp.StartAuthFlow], except it also returns the state
+// parameter, which is needed to match the callback request to this login process.
+func (o *OAuthLogin) startAuthFlow(ctx context.Context, identifier string) (redirectURL, state string, err error) {
+	app := o.Main.OAuth
+	var authServerURL, loginHint string
+	var accountDID syntax.DID
+	if strings.HasPrefix(identifier, "https://") {
+		authServerURL = identifier
+	} else {
+		atid, err := syntax.ParseAtIdentifier(strings.TrimPrefix(identifier, "@"))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid handle or DID: %w", err)
+		}
+		ident, err := app.Dir.Lookup(ctx, atid)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to resolve %s: %w", identifier, err)
+		}
+		pdsEndpoint := ident.PDSEndpoint()
+		if pdsEndpoint == "" {
+			return "", "", fmt.Errorf("%s doesn't have a PDS", identifier)
+		}
+		authServerURL, err = app.Resolver.ResolveAuthServerURL(ctx, pdsEndpoint)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to resolve authorization server: %w", err)
+		}
+		accountDID = ident.DID
+		loginHint = atid.String()
+	}
+	authServerMeta, err := app.Resolver.ResolveAuthServerMetadata(ctx, authServerURL)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to fetch authorization server metadata: %w", err)
+	}
+	info, err := app.SendAuthRequest(ctx, authServerMeta, app.Config.Scopes, loginHint)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to send authorization request: %w", err)
+	}
+	if accountDID != "" {
+		info.AccountDID = &accountDID
+	}
+	err = app.Store.SaveAuthRequestInfo(ctx, *info)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to save authorization request: %w", err)
+	}
+	params := url.Values{}
+	params.Set("client_id", app.Config.ClientID)
+	params.Set("request_uri", info.RequestURI)
+	return fmt.Sprintf("%s?%s", authServerMeta.AuthorizationEndpoint, params.Encode()), info.State, nil
+}
+
+func (o *OAuthLogin) SubmitUserInput(ctx context.Context, input map[string]string) (*bridgev2.LoginStep, error) {
+	redirectURL, state, err := o.startAuthFlow(ctx, strings.TrimSpace(input["identifier"]))
+	if err != nil {
+		return nil, err
+	}
+	o.state = state
+	o.callback = make(chan url.Values, 1)
+	o.Main.oauthCallbacks.Set(state, o.callback)
+	return &bridgev2.LoginStep{
+		Type:         bridgev2.LoginStepTypeDisplayAndWait,
+		StepID:       "fi.mau.bluesky.oauth.authorize",
+		Instructions: "Open the link below in your browser and approve the login",
+		DisplayAndWaitParams: &bridgev2.LoginDisplayAndWaitParams{
+			Type: bridgev2.LoginDisplayTypeCode,
+			Data: redirectURL,
+		},
+	}, nil
+}
+
+func (o *OAuthLogin) Wait(ctx context.Context) (*bridgev2.LoginStep, error) {
+	defer o.Cancel()
+	var params url.Values
+	timer := time.NewTimer(oauthLoginTimeout)
+	defer timer.Stop()
+	select {
+	case params = <-o.callback:
+	case <-timer.C:
+		return nil, fmt.Errorf("login timed out, please try again")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	sessData, err := o.Main.OAuth.ProcessCallback(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to complete authorization: %w", err)
+	}
+	meta := &UserLoginMetadata{
+		Host:  sessData.HostURL,
+		OAuth: sessData,
+	}
+	// The session data isn't saved anywhere until the login is created below
+	sess, err := o.Main.newOAuthSession(sessData, nil)
+	if err != nil {
+		return nil, err
+	}
+	cli := &xrpc.Client{
+		Client: &http.Client{Transport: &oauthTransport{
+			Session: sess,
+			Client:  o.Main.HTTPClient,
+		}},
+		Host:      sessData.HostURL,
+		UserAgent: &o.Main.UserAgent,
+	}
+	resp, err := atproto.ServerGetSession(ctx, cli)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session info: %w", err)
+	} else if resp.Did != sessData.AccountDID.String() {
+		return nil, fmt.Errorf("session DID %s doesn't match authorized DID %s", resp.Did, sessData.AccountDID)
+	}
+	chatService, err := o.Main.getLoginChatService(o.User, resp.Did)
+	if err != nil {
+		return nil, err
+	}
+	err = checkChatAccess(ctx, &xrpc.Client{
+		Client:    cli.Client,
+		Host:      cli.Host,
+		UserAgent: cli.UserAgent,
+		Headers:   proxyHeaders(chatService),
+	})
+	if err != nil {
+		return nil, err
+	}
+	meta.Auth = &xrpc.AuthInfo{
+		Handle: resp.Handle,
+		Did:    resp.Did,
+	}
+	return completeLogin(ctx, o.User, &database.UserLogin{
+		ID:         makeUserLoginID(resp.Did),
+		RemoteName: resp.Handle,
+		RemoteProfile: status.RemoteProfile{
+			Email:    ptr.Val(resp.Email),
+			Username: resp.Handle,
+		},
+		Metadata: meta,
+	})
+}
@@ -0,0 +1,374 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+const (
+	testOAuthDID        = "did:plc:testoauthuser"
+	testOAuthHandle     = "alice.example.com"
+	testBridgeAddress   = "https://bridge.example.com"
+	testRequestURI      = "urn:ietf:params:oauth:request_uri:test"
+	testAuthCode        = "test-auth-code"
+	testAuthServerNonce = "auth-server-nonce"
+	testPDSNonce        = "pds-nonce"
+)
+
+// testAuthServer is a minimal stand-in for an atproto PDS with an embedded authorization server.
+// It requires DPoP nonces on every endpoint, so each client has to go through the nonce retry once.
+type testAuthServer struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	lock          sync.Mutex
+	codeChallenge string
+	state         string
+	generation    int
+	nonceRetries  map[string]int
+}
+
+func newTestAuthServer(t *testing.T) *testAuthServer {
+	as := &testAuthServer{t: t, nonceRetries: make(map[string]int)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/oauth-protected-resource", as.serveProtectedResource)
+	mux.HandleFunc("GET /.well-known/oauth-authorization-server", as.serveMetadata)
+	mux.HandleFunc("POST /oauth/par", as.servePAR)
+	mux.HandleFunc("POST /oauth/token", as.serveToken)
+	mux.HandleFunc("GET /xrpc/com.atproto.server.getSession", as.serveGetSession)
+	as.srv = httptest.NewTLSServer(mux)
+	t.Cleanup(as.srv.Close)
+	return as
+}
+
+func writeTestJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (as *testAuthServer) serveProtectedResource(w http.ResponseWriter, r *http.Request) {
+	writeTestJSON(w, http.StatusOK, map[string]any{
+		"resource":              as.srv.URL,
+		"authorization_servers": []string{as.srv.URL},
+	})
+}
+
+func (as *testAuthServer) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	writeTestJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                           as.srv.URL,
+		"authorization_endpoint":                           as.srv.URL + "/oauth/authorize",
+		"token_endpoint":                                   as.srv.URL + "/oauth/token",
+		"pushed_authorization_request_endpoint":            as.srv.URL + "/oauth/par",
+		"response_types_supported":                         []string{"code"},
+		"grant_types_supported":                            []string{"authorization_code", "refresh_token"},
+		"code_challenge_methods_supported":                 []string{"S256"},
+		"token_endpoint_auth_methods_supported":            []string{"none", "private_key_jwt"},
+		"token_endpoint_auth_signing_alg_values_supported": []string{"ES256"},
+		"scopes_supported":                                 oauthScopes,
+		"authorization_response_iss_parameter_supported":   true,
+		"require_pushed_authorization_requests":            true,
+		"require_request_uri_registration":                 true,
+		"dpop_signing_alg_values_supported":                []string{"ES256"},
+		"client_id_metadata_document_supported":            true,
+	})
+}
+
+// checkDPoP verifies that the request has a DPoP proof with the expected nonce. If it doesn't,
+// an error asking the client to retry with the nonce is sent and false is returned.
+func (as *testAuthServer) checkDPoP(w http.ResponseWriter, r *http.Request, endpoint, nonce string, resourceServer bool) bool {
+	var claims struct {
+		Nonce string `json:"nonce"`
+		HTM   string `json:"htm"`
+	}
+	parts := strings.Split(r.Header.Get("DPoP"), ".")
+	if !assert.Len(as.t, parts, 3, "DPoP proof for %s isn't a JWT", endpoint) {
+		writeTestJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_dpop_proof"})
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(payload, &claims)
+	}
+	if !assert.NoError(as.t, err, "Failed to parse DPoP proof for %s", endpoint) {
+		writeTestJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_dpop_proof"})
+		return false
+	}
+	assert.Equal(as.t, r.Method, claims.HTM)
+	if claims.Nonce == nonce {
+		return true
+	}
+	as.lock.Lock()
+	as.nonceRetries[endpoint]++
+	as.lock.Unlock()
+	w.Header().Set("DPoP-Nonce", nonce)
+	if resourceServer {
+		w.Header().Set("WWW-Authenticate", `DPoP error="use_dpop_nonce", error_description="Resource server requires nonce in DPoP proof"`)
+		writeTestJSON(w, http.StatusUnauthorized, map[string]string{"error": "use_dpop_nonce"})
+	} else {
+		writeTestJSON(w, http.StatusBadRequest, map[string]string{"error": "use_dpop_nonce"})
+	}
+	return false
+}
+
+func (as *testAuthServer) servePAR(w http.ResponseWriter, r *http.Request) {
+	if !as.checkDPoP(w, r, "par", testAuthServerNonce, false) {
+		return
+	}
+	assert.NoError(as.t, r.ParseForm())
+	assert.Equal(as.t, testBridgeAddress+oauthClientMetadataPath, r.PostForm.Get("client_id"))
+	assert.Equal(as.t, testBridgeAddress+oauthCallbackPath, r.PostForm.Get("redirect_uri"))
+	assert.Equal(as.t, "code", r.PostForm.Get("response_type"))
+	assert.Equal(as.t, "S256", r.PostForm.Get("code_challenge_method"))
+	assert.NotEmpty(as.t, r.PostForm.Get("code_challenge"))
+	assert.NotEmpty(as.t, r.PostForm.Get("state"))
+	assert.Equal(as.t, strings.Join(oauthScopes, " "), r.PostForm.Get("scope"))
+	as.lock.Lock()
+	as.codeChallenge = r.PostForm.Get("code_challenge")
+	as.state = r.PostForm.Get("state")
+	as.lock.Unlock()
+	writeTestJSON(w, http.StatusCreated, map[string]any{
+		"request_uri": testRequestURI,
+		"expires_in":  60,
+	})
+}
+
+func (as *testAuthServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	if !as.checkDPoP(w, r, "token", testAuthServerNonce, false) {
+		return
+	}
+	assert.NoError(as.t, r.ParseForm())
+	assert.Equal(as.t, testBridgeAddress+oauthClientMetadataPath, r.PostForm.Get("client_id"))
+	as.lock.Lock()
+	defer as.lock.Unlock()
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		assert.Equal(as.t, testAuthCode, r.PostForm.Get("code"))
+		assert.Equal(as.t, testBridgeAddress+oauthCallbackPath, r.PostForm.Get("redirect_uri"))
+		verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifierHash[:]) != as.codeChallenge {
+			writeTestJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		}
+		as.generation = 1
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") != as.refreshToken() {
+			writeTestJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		as.generation++
+	default:
+		writeTestJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	writeTestJSON(w, http.StatusOK, map[string]any{
+		"access_token":  as.accessToken(),
+		"refresh_token": as.refreshToken(),
+		"token_type":    "DPoP",
+		"scope":         strings.Join(oauthScopes, " "),
+		"expires_in":    3600,
+		"sub":           testOAuthDID,
+	})
+}
+
+func (as *testAuthServer) getNonceRetries(endpoint string) int {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+	return as.nonceRetries[endpoint]
+}
+
+func (as *testAuthServer) accessToken() string {
+	return "access-" + strings.Repeat("x", as.generation)
+}
+
+func (as *testAuthServer) refreshToken() string {
+	return "refresh-" + strings.Repeat("x", as.generation)
+}
+
+func (as *testAuthServer) serveGetSession(w http.ResponseWriter, r *http.Request) {
+	if !as.checkDPoP(w, r, "getSession", testPDSNonce, true) {
+		return
+	}
+	as.lock.Lock()
+	expectedAuth := "DPoP " + as.accessToken()
+	as.lock.Unlock()
+	if r.Header.Get("Authorization") != expectedAuth {
+		writeTestJSON(w, http.StatusUnauthorized, map[string]string{"error": "InvalidToken"})
+		return
+	}
+	writeTestJSON(w, http.StatusOK, map[string]any{
+		"did":    testOAuthDID,
+		"handle": testOAuthHandle,
+	})
+}
+
+func newTestOAuthConnector(as *testAuthServer) *BlueskyConnector {
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:    syntax.DID(testOAuthDID),
+		Handle: syntax.Handle(testOAuthHandle),
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: as.srv.URL},
+		},
+	})
+	b := &BlueskyConnector{
+		HTTPClient: as.srv.Client(),
+		UserAgent:  "mautrix-bluesky-test",
+		Directory:  &dir,
+	}
+	b.setupOAuth(testBridgeAddress)
+	return b
+}
+
+func TestOAuthLogin(t *testing.T) {
+	ctx := context.Background()
+	as := newTestAuthServer(t)
+	b := newTestOAuthConnector(as)
+	login := &OAuthLogin{Main: b}
+
+	step, err := login.SubmitUserInput(ctx, map[string]string{"identifier": "@" + testOAuthHandle})
+	require.NoError(t, err)
+	assert.Equal(t, bridgev2.LoginStepTypeDisplayAndWait, step.Type)
+	authorizeURL, err := url.Parse(step.DisplayAndWaitParams.Data)
+	require.NoError(t, err)
+	assert.Equal(t, as.srv.URL+"/oauth/authorize", authorizeURL.Scheme+"://"+authorizeURL.Host+authorizeURL.Path)
+	assert.Equal(t, testRequestURI, authorizeURL.Query().Get("request_uri"))
+	assert.Equal(t, testBridgeAddress+oauthClientMetadataPath, authorizeURL.Query().Get("client_id"))
+	as.lock.Lock()
+	assert.Equal(t, as.state, login.state)
+	as.lock.Unlock()
+	assert.Equal(t, 1, as.getNonceRetries("par"))
+
+	// The authorization server redirects the user's browser back to the bridge after they approve the login
+	callbackQuery := url.Values{
+		"state": {login.state},
+		"iss":   {as.srv.URL},
+		"code":  {testAuthCode},
+	}
+	rec := httptest.NewRecorder()
+	b.serveOAuthCallback(rec, httptest.NewRequest(http.MethodGet, oauthCallbackPath+"?"+callbackQuery.Encode(), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	// The state is single-use
+	rec = httptest.NewRecorder()
+	b.serveOAuthCallback(rec, httptest.NewRequest(http.MethodGet, oauthCallbackPath+"?"+callbackQuery.Encode(), nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	var params url.Values
+	select {
+	case params = <-login.callback:
+	default:
+		t.Fatal("Callback handler didn't pass the parameters to the login process")
+	}
+	sessData, err := b.OAuth.ProcessCallback(ctx, params)
+	require.NoError(t, err)
+	assert.Equal(t, testOAuthDID, sessData.AccountDID.String())
+	assert.Equal(t, as.srv.URL, sessData.HostURL)
+	assert.Equal(t, "access-x", sessData.AccessToken)
+	assert.Equal(t, "refresh-x", sessData.RefreshToken)
+	assert.Equal(t, 1, as.getNonceRetries("token"))
+
+	var persisted *oauth.ClientSessionData
+	sess, err := b.newOAuthSession(sessData, func(ctx context.Context, data *oauth.ClientSessionData) {
+		persisted = data
+	})
+	require.NoError(t, err)
+	cli := &xrpc.Client{
+		Client: &http.Client{Transport: &oauthTransport{Session: sess, Client: b.HTTPClient}},
+		Host:   sessData.HostURL,
+	}
+	resp, err := atproto.ServerGetSession(ctx, cli)
+	require.NoError(t, err)
+	assert.Equal(t, testOAuthDID, resp.Did)
+	assert.Equal(t, 1, as.getNonceRetries("getSession"))
+
+	_, err = sess.RefreshTokens(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, persisted)
+	assert.Equal(t, "access-xx", persisted.AccessToken)
+	assert.Equal(t, "refresh-xx", persisted.RefreshToken)
+	// Requests after the refresh must use the new access token
+	resp, err = atproto.ServerGetSession(ctx, cli)
+	require.NoError(t, err)
+	assert.Equal(t, testOAuthDID, resp.Did)
+}
+
+func TestOAuthCallback_UnknownState(t *testing.T) {
+	as := newTestAuthServer(t)
+	b := newTestOAuthConnector(as)
+	rec := httptest.NewRecorder()
+	b.serveOAuthCallback(rec, httptest.NewRequest(http.MethodGet, oauthCallbackPath+"?state=unknown&code=abc", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestOAuthLoginWait_Timeout(t *testing.T) {
+	origTimeout := oauthLoginTimeout
+	oauthLoginTimeout = 10 * time.Millisecond
+	t.Cleanup(func() {
+		oauthLoginTimeout = origTimeout
+	})
+	as := newTestAuthServer(t)
+	b := newTestOAuthConnector(as)
+	login := &OAuthLogin{Main: b}
+	_, err := login.SubmitUserInput(context.Background(), map[string]string{"identifier": "@" + testOAuthHandle})
+	require.NoError(t, err)
+
+	_, err = login.Wait(context.Background())
+	assert.ErrorContains(t, err, "timed out")
+	// The pending login is cleaned up, so approving it afterwards doesn't do anything
+	_, ok := b.oauthCallbacks.Get(login.state)
+	assert.False(t, ok)
+	_, err = b.OAuth.Store.GetAuthRequestInfo(context.Background(), login.state)
+	assert.Error(t, err)
+}
+
+func TestOAuthLoginWait_Cancel(t *testing.T) {
+	as := newTestAuthServer(t)
+	b := newTestOAuthConnector(as)
+	login := &OAuthLogin{Main: b}
+	_, err := login.SubmitUserInput(context.Background(), map[string]string{"identifier": "@" + testOAuthHandle})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = login.Wait(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, ok := b.oauthCallbacks.Get(login.state)
+	assert.False(t, ok)
+	rec := httptest.NewRecorder()
+	b.serveOAuthCallback(rec, httptest.NewRequest(http.MethodGet, oauthCallbackPath+"?state="+url.QueryEscape(login.state), nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
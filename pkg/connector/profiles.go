@@ -0,0 +1,220 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const (
+	profileCacheTTL = 30 * time.Minute
+	// profileBatchSize is the maximum number of actors app.bsky.actor.getProfiles accepts
+	profileBatchSize = 25
+	// profileFetchTimeout is the timeout for shared profile fetches, which don't use the context of any single caller
+	profileFetchTimeout = 1 * time.Minute
+)
+
+var errProfileNotFound = errors.New("profile not found")
+
+type cachedProfile struct {
+	profile   *bsky.ActorDefs_ProfileViewDetailed
+	fetchedAt time.Time
+}
+
+// profileFetch is an in-flight request for a profile, either alone or as a part of a batch.
+type profileFetch struct {
+	done    chan struct{}
+	profile *bsky.ActorDefs_ProfileViewDetailed
+	err     error
+}
+
+func (pf *profileFetch) wait(ctx context.Context) (*bsky.ActorDefs_ProfileViewDetailed, error) {
+	select {
+	case <-pf.done:
+		return pf.profile, pf.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ProfileCache is a connector-wide cache of Bluesky profiles, shared by all logins.
+//
+// The viewer state is removed from cached profiles, as it depends on which login fetched the profile.
+type ProfileCache struct {
+	TTL time.Duration
+
+	profiles map[string]cachedProfile
+	inflight map[string]*profileFetch
+	lock     sync.Mutex
+}
+
+func NewProfileCache(ttl time.Duration) *ProfileCache {
+	return &ProfileCache{
+		TTL:      ttl,
+		profiles: make(map[string]cachedProfile),
+		inflight: make(map[string]*profileFetch),
+	}
+}
+
+func (pc *ProfileCache) getCached(did string) *bsky.ActorDefs_ProfileViewDetailed {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	return pc.unlockedGetCached(did)
+}
+
+func (pc *ProfileCache) unlockedGetCached(did string) *bsky.ActorDefs_ProfileViewDetailed {
+	cached, ok := pc.profiles[did]
+	if !ok || time.Since(cached.fetchedAt) > pc.TTL {
+		return nil
+	}
+	return cached.profile
+}
+
+// startFetches finds the in-flight fetch for each of the given DIDs that aren't cached. If a DID isn't being
+// fetched yet, a new fetch is created and the DID is included in the owned list, which the caller must fetch
+// and pass to finishFetches.
+func (pc *ProfileCache) startFetches(dids []string) (fetches map[string]*profileFetch, owned []string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	fetches = make(map[string]*profileFetch, len(dids))
+	for _, did := range dids {
+		if _, alreadyAdded := fetches[did]; alreadyAdded || pc.unlockedGetCached(did) != nil {
+			continue
+		}
+		fetch, ok := pc.inflight[did]
+		if !ok {
+			fetch = &profileFetch{done: make(chan struct{})}
+			pc.inflight[did] = fetch
+			owned = append(owned, did)
+		}
+		fetches[did] = fetch
+	}
+	return
+}
+
+// finishFetches stores the fetched profiles in the cache and wakes up everyone waiting for the given DIDs.
+// DIDs that aren't in the profile list get the given error, or errProfileNotFound if the error is nil.
+func (pc *ProfileCache) finishFetches(dids []string, profiles []*bsky.ActorDefs_ProfileViewDetailed, err error) {
+	now := time.Now()
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	fetched := make(map[string]*bsky.ActorDefs_ProfileViewDetailed, len(profiles))
+	for _, profile := range profiles {
+		profile.Viewer = nil
+		pc.profiles[profile.Did] = cachedProfile{profile: profile, fetchedAt: now}
+		fetched[profile.Did] = profile
+	}
+	if err == nil {
+		err = errProfileNotFound
+	}
+	for _, did := range dids {
+		fetch, ok := pc.inflight[did]
+		if !ok {
+			continue
+		}
+		delete(pc.inflight, did)
+		if profile, ok := fetched[did]; ok {
+			fetch.profile = profile
+		} else {
+			fetch.err = err
+		}
+		close(fetch.done)
+	}
+	for did, cached := range pc.profiles {
+		if now.Sub(cached.fetchedAt) > pc.TTL {
+			delete(pc.profiles, did)
+		}
+	}
+}
+
+// fetch fetches the given DIDs, which must have been returned in the owned list of startFetches.
+//
+// The fetch is shared by everyone waiting for the DIDs, so it uses a detached context with its own timeout
+// instead of the context of the caller who happened to start it.
+func (pc *ProfileCache) fetch(ctx context.Context, cli *xrpc.Client, dids []string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), profileFetchTimeout)
+	defer cancel()
+	if len(dids) == 1 {
+		profile, err := bsky.ActorGetProfile(ctx, cli, dids[0])
+		if err != nil {
+			pc.finishFetches(dids, nil, err)
+		} else {
+			pc.finishFetches(dids, []*bsky.ActorDefs_ProfileViewDetailed{profile}, nil)
+		}
+		return
+	}
+	for batch := range slices.Chunk(dids, profileBatchSize) {
+		resp, err := bsky.ActorGetProfiles(ctx, cli, batch)
+		if err != nil {
+			pc.finishFetches(batch, nil, fmt.Errorf("failed to fetch profiles: %w", err))
+		} else {
+			pc.finishFetches(batch, resp.Profiles, nil)
+		}
+	}
+}
+
+// Invalidate removes the given DID from the cache, so the next Get will fetch it again.
+func (pc *ProfileCache) Invalidate(did string) {
+	pc.lock.Lock()
+	delete(pc.profiles, did)
+	pc.lock.Unlock()
+}
+
+// Get returns the profile of the given DID, either from the cache or by fetching it using the given client.
+// Concurrent requests for the same DID, including ones in a Prefetch batch, are merged into one request.
+func (pc *ProfileCache) Get(ctx context.Context, cli *xrpc.Client, did string) (*bsky.ActorDefs_ProfileViewDetailed, error) {
+	if profile := pc.getCached(did); profile != nil {
+		return profile, nil
+	}
+	fetches, owned := pc.startFetches([]string{did})
+	fetch, ok := fetches[did]
+	if !ok {
+		// The profile was cached between the two checks
+		if profile := pc.getCached(did); profile != nil {
+			return profile, nil
+		}
+		return nil, errProfileNotFound
+	}
+	if len(owned) > 0 {
+		go pc.fetch(ctx, cli, owned)
+	}
+	return fetch.wait(ctx)
+}
+
+// Prefetch fetches all the given DIDs that aren't already cached in batches of 25.
+// DIDs that are already being fetched by someone else are waited for instead of being fetched again.
+func (pc *ProfileCache) Prefetch(ctx context.Context, cli *xrpc.Client, dids []string) error {
+	fetches, owned := pc.startFetches(dids)
+	if len(owned) > 0 {
+		go pc.fetch(ctx, cli, owned)
+	}
+	for _, fetch := range fetches {
+		_, err := fetch.wait(ctx)
+		if err != nil && !errors.Is(err, errProfileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/rivo/uniseg"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// Bluesky chats don't have replies, so they're emulated by prepending a quote of the replied-to message:
+//
+//	> @alice.bsky.social: the original message…
+//	the reply
+//
+// The same format is detected in incoming messages to turn them back into Matrix replies.
+var replyQuoteRegex = regexp.MustCompile(`^> @(\S+?): (.*)\n+`)
+
+const replyQuoteEllipsis = "…"
+
+// quoteCandidateCount is the number of recent messages searched when finding the target of a reply quote.
+const quoteCandidateCount = 50
+
+// quoteLocalCheckCount is the maximum number of bridged messages from the quoted user whose Matrix events
+// are fetched when finding the target of a reply quote, see findLocalQuotedMessage.
+const quoteLocalCheckCount = 5
+
+func formatReplyQuote(handle, body string, maxLength int) string {
+	quote := strings.Join(strings.Fields(body), " ")
+	if uniseg.GraphemeClusterCount(quote) > maxLength {
+		quote = truncateGraphemes(quote, maxLength) + replyQuoteEllipsis
+	}
+	return "> @" + handle + ": " + quote + "\n"
+}
+
+func parseReplyQuote(text string) (handle, quote, rest string, ok bool) {
+	match := replyQuoteRegex.FindStringSubmatchIndex(text)
+	if match == nil {
+		return
+	}
+	handle = text[match[2]:match[3]]
+	quote = strings.TrimSuffix(text[match[4]:match[5]], replyQuoteEllipsis)
+	rest = text[match[1]:]
+	return handle, quote, rest, quote != ""
+}
+
+func truncateGraphemes(text string, maxLength int) string {
+	graphemes := uniseg.NewGraphemes(text)
+	end := 0
+	for i := 0; i < maxLength && graphemes.Next(); i++ {
+		_, end = graphemes.Positions()
+	}
+	return strings.TrimSpace(text[:end])
+}
+
+// makeReplyQuote returns the quote to prepend to a Matrix reply, or an empty string if there's no reply
+// or reply quotes are disabled.
+func (b *BlueskyClient) makeReplyQuote(ctx context.Context, msg *bridgev2.MatrixMessage) string {
+	if msg.ReplyTo == nil || b.Main.Config.ReplyQuoteLength <= 0 {
+		return ""
+	}
+	log := zerolog.Ctx(ctx)
+	evt, err := msg.Portal.Bridge.Bot.GetEvent(ctx, msg.Portal.MXID, msg.ReplyTo.MXID)
+	if err != nil {
+		log.Warn().Err(err).Stringer("reply_to_mxid", msg.ReplyTo.MXID).Msg("Failed to get reply target event for quote")
+		return ""
+	}
+	content := evt.Content.AsMessage()
+	content.RemoveReplyFallback()
+	if content.Body == "" {
+		return ""
+	}
+	return formatReplyQuote(b.getSenderHandle(ctx, msg.ReplyTo.SenderID), content.Body, b.Main.Config.ReplyQuoteLength)
+}
+
+func (b *BlueskyClient) getSenderHandle(ctx context.Context, senderID networkid.UserID) string {
+	did := parseUserID(senderID)
+	if did.String() == b.XRPC.Auth.Did && b.XRPC.Auth.Handle != "" {
+		return b.XRPC.Auth.Handle
+	}
+	ghost, err := b.Main.Bridge.GetGhostByID(ctx, senderID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("sender_id", string(senderID)).Msg("Failed to get ghost for reply quote")
+	} else if handle := ghost.Metadata.(*GhostMetadata).Handle; handle != "" {
+		return handle
+	}
+	return did.String()
+}
+
+// findQuotedMessage checks if the given message starts with a reply quote and tries to find the quoted message.
+// Recently bridged messages are checked first, and recent messages in the convo are only fetched from Bluesky
+// if the target isn't found locally. If found, the reply target and the message text without the quote are returned.
+func (b *BlueskyClient) findQuotedMessage(
+	ctx context.Context, portal *bridgev2.Portal, msg *chat.ConvoDefs_MessageView,
+) (*networkid.MessageOptionalPartID, string) {
+	handle, quote, rest, ok := parseReplyQuote(msg.Text)
+	if !ok {
+		return nil, msg.Text
+	}
+	ctx = zerolog.Ctx(ctx).With().Str("quoted_handle", handle).Logger().WithContext(ctx)
+	target := b.findLocalQuotedMessage(ctx, portal, handle, quote, msg.Rev)
+	if target == nil {
+		// The quoted message may not have been bridged, e.g. if it was sent before the portal was created
+		target = b.findRemoteQuotedMessage(ctx, portal, handle, quote, msg)
+	}
+	if target == nil {
+		zerolog.Ctx(ctx).Debug().Msg("Reply quote target not found in recent messages")
+		return nil, msg.Text
+	}
+	return target, rest
+}
+
+// findLocalQuotedMessage searches recently bridged messages in the portal for the target of a reply quote.
+// The message table doesn't contain the text, so the Matrix events of up to quoteLocalCheckCount messages
+// from the quoted user are fetched to compare with the quote.
+func (b *BlueskyClient) findLocalQuotedMessage(
+	ctx context.Context, portal *bridgev2.Portal, handle, quote, beforeRev string,
+) *networkid.MessageOptionalPartID {
+	log := zerolog.Ctx(ctx)
+	candidates, err := b.Main.Bridge.DB.Message.GetLastNInPortal(ctx, portal.PortalKey, quoteCandidateCount)
+	if err != nil {
+		log.Err(err).Msg("Failed to get recent messages to find reply quote target")
+		return nil
+	}
+	checked := 0
+	// Messages are returned newest first, so the most recent matching message is picked
+	for _, candidate := range candidates {
+		rev := candidate.Metadata.(*MessageMetadata).Rev
+		if (rev != "" && rev >= beforeRev) || !strings.EqualFold(b.getSenderHandle(ctx, candidate.SenderID), handle) {
+			continue
+		} else if checked >= quoteLocalCheckCount {
+			break
+		}
+		checked++
+		evt, err := portal.Bridge.Bot.GetEvent(ctx, portal.MXID, candidate.MXID)
+		if err != nil {
+			log.Debug().Err(err).Stringer("candidate_mxid", candidate.MXID).Msg("Failed to get candidate event for reply quote")
+			continue
+		}
+		content := evt.Content.AsMessage()
+		content.RemoveReplyFallback()
+		if quoteMatches(content.Body, quote) {
+			return &networkid.MessageOptionalPartID{
+				MessageID: candidate.ID,
+				PartID:    &candidate.PartID,
+			}
+		}
+	}
+	return nil
+}
+
+// findRemoteQuotedMessage searches the last quoteCandidateCount messages in the convo on Bluesky
+// for the target of a reply quote.
+func (b *BlueskyClient) findRemoteQuotedMessage(
+	ctx context.Context, portal *bridgev2.Portal, handle, quote string, msg *chat.ConvoDefs_MessageView,
+) *networkid.MessageOptionalPartID {
+	log := zerolog.Ctx(ctx)
+	atID, err := syntax.ParseAtIdentifier(handle)
+	if err != nil {
+		return nil
+	}
+	ident, err := b.Main.Directory.Lookup(ctx, atID)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to resolve sender of reply quote")
+		return nil
+	}
+	resp, err := chat.ConvoGetMessages(ctx, b.ChatRPC, parsePortalID(portal.ID), "", quoteCandidateCount)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to fetch messages to find reply quote target")
+		return nil
+	}
+	for _, candidate := range resp.Messages {
+		view := candidate.ConvoDefs_MessageView
+		if view == nil || view.Sender.Did != ident.DID.String() || view.Rev >= msg.Rev || view.Id == msg.Id {
+			continue
+		}
+		if quoteMatches(view.Text, quote) {
+			return &networkid.MessageOptionalPartID{
+				MessageID: makeMessageID(portal.ID, view.Id),
+			}
+		}
+	}
+	return nil
+}
+
+// quoteMatches checks if the given message text starts with the quote. If the text has a reply quote of its own,
+// only the text after it is compared.
+func quoteMatches(text, quote string) bool {
+	if _, _, withoutQuote, ok := parseReplyQuote(text); ok {
+		text = withoutQuote
+	}
+	return strings.HasPrefix(strings.Join(strings.Fields(text), " "), quote)
+}
@@ -0,0 +1,77 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/chat"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+)
+
+// reportReasons maps the short reason names accepted by the report command to moderation reason types.
+var reportReasons = map[string]string{
+	"spam":       "com.atproto.moderation.defs#reasonSpam",
+	"violation":  "com.atproto.moderation.defs#reasonViolation",
+	"misleading": "com.atproto.moderation.defs#reasonMisleading",
+	"sexual":     "com.atproto.moderation.defs#reasonSexual",
+	"rude":       "com.atproto.moderation.defs#reasonRude",
+	"other":      "com.atproto.moderation.defs#reasonOther",
+}
+
+// reportInput is the input for com.atproto.moderation.createReport. The generated input type
+// doesn't allow chat message references as the subject, so the subject is left untyped here.
+type reportInput struct {
+	ReasonType string  `json:"reasonType"`
+	Reason     *string `json:"reason,omitempty"`
+	Subject    any     `json:"subject"`
+}
+
+func (b *BlueskyClient) createReport(ctx context.Context, subject any, reasonType, comment string) (*atproto.ModerationCreateReport_Output, error) {
+	input := &reportInput{
+		ReasonType: reasonType,
+		Subject:    subject,
+	}
+	if comment != "" {
+		input.Reason = &comment
+	}
+	var out atproto.ModerationCreateReport_Output
+	err := b.Moderation.LexDo(ctx, lexutil.Procedure, "application/json", "com.atproto.moderation.createReport", nil, input, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// reportMessage reports a single chat message to the moderation service.
+func (b *BlueskyClient) reportMessage(ctx context.Context, convoID, messageID, senderDID, reasonType, comment string) (*atproto.ModerationCreateReport_Output, error) {
+	return b.createReport(ctx, &chat.ConvoDefs_MessageRef{
+		LexiconTypeID: "chat.bsky.convo.defs#messageRef",
+		ConvoId:       convoID,
+		MessageId:     messageID,
+		Did:           senderDID,
+	}, reasonType, comment)
+}
+
+// reportAccount reports an entire account to the moderation service.
+func (b *BlueskyClient) reportAccount(ctx context.Context, did, reasonType, comment string) (*atproto.ModerationCreateReport_Output, error) {
+	return b.createReport(ctx, &atproto.AdminDefs_RepoRef{
+		LexiconTypeID: "com.atproto.admin.defs#repoRef",
+		Did:           did,
+	}, reasonType, comment)
+}
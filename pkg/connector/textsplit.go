@@ -0,0 +1,83 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
+const (
+	// maxMessageGraphemes is the maximum length of a single Bluesky chat message.
+	maxMessageGraphemes = 1000
+	// maxMessageSplitParts is the maximum number of messages a long Matrix message will be split into.
+	maxMessageSplitParts = 10
+)
+
+// graphemePrefix returns the byte length of the first n grapheme clusters of the string.
+func graphemePrefix(text string, n int) int {
+	state := -1
+	rest := text
+	for i := 0; i < n && len(rest) > 0; i++ {
+		_, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+	}
+	return len(text) - len(rest)
+}
+
+// findSplitPoint finds the best place to split the given chunk, preferring paragraph breaks,
+// then line breaks, then sentence ends and finally any whitespace. Only break points in the second half
+// of the chunk are accepted, so that a break near the start doesn't produce a tiny part and waste one of
+// the maxMessageSplitParts. Returns -1 if there's no good place.
+func findSplitPoint(chunk string) int {
+	minIndex := max(len(chunk)/2, 1)
+	if idx := strings.LastIndex(chunk, "\n\n"); idx >= minIndex {
+		return idx
+	} else if idx = strings.LastIndexByte(chunk, '\n'); idx >= minIndex {
+		return idx
+	}
+	for i := len(chunk) - 1; i >= minIndex; i-- {
+		if (chunk[i] == ' ' || chunk[i] == '\t') && strings.IndexByte(".!?", chunk[i-1]) >= 0 {
+			return i
+		}
+	}
+	if idx := strings.LastIndexAny(chunk, " \t"); idx >= minIndex {
+		return idx
+	}
+	return -1
+}
+
+// splitText splits text into parts that are at most limit graphemes long.
+// Whitespace at the split points is removed.
+func splitText(text string, limit int) []string {
+	var parts []string
+	for uniseg.GraphemeClusterCount(text) > limit {
+		chunk := text[:graphemePrefix(text, limit)]
+		splitAt := findSplitPoint(chunk)
+		if splitAt <= 0 {
+			splitAt = len(chunk)
+		}
+		if part := strings.TrimSpace(text[:splitAt]); part != "" {
+			parts = append(parts, part)
+		}
+		text = strings.TrimLeft(text[splitAt:], " \t\n")
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
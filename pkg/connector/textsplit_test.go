@@ -0,0 +1,117 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rivo/uniseg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testFamilyEmoji = "👨‍👩‍👧"
+	testFlagEmoji   = "🇫🇮"
+	testCombiningE  = "é"
+)
+
+func TestSplitText(t *testing.T) {
+	testCases := []struct {
+		name     string
+		text     string
+		limit    int
+		expected []string
+	}{
+		{"Short", "short", 20, []string{"short"}},
+		{"Paragraph", "aaaa bbbb cccc\n\ndddd eeee", 20, []string{"aaaa bbbb cccc", "dddd eeee"}},
+		{"EarlyParagraphIgnored", "hi\n\nthis is a longer paragraph", 20, []string{"hi\n\nthis is a", "longer paragraph"}},
+		{"Line", "aaaa bbbb cccc\ndddd eeee", 20, []string{"aaaa bbbb cccc", "dddd eeee"}},
+		{"Sentence", "Hello there world. Foo bar baz", 26, []string{"Hello there world.", "Foo bar baz"}},
+		{"Word", "aaaa bbbb cccc dddd eeee", 12, []string{"aaaa bbbb", "cccc dddd", "eeee"}},
+		{"NoWhitespace", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"CombiningCharacters", strings.Repeat(testCombiningE, 5), 2, []string{
+			strings.Repeat(testCombiningE, 2), strings.Repeat(testCombiningE, 2), testCombiningE,
+		}},
+		{"ZWJEmoji", strings.Repeat(testFamilyEmoji, 3), 2, []string{testFamilyEmoji + testFamilyEmoji, testFamilyEmoji}},
+		{"FlagEmoji", strings.Repeat(testFlagEmoji, 3), 2, []string{testFlagEmoji + testFlagEmoji, testFlagEmoji}},
+		{"EmojiWords", strings.Repeat(testFamilyEmoji+" ", 3) + testFamilyEmoji, 4, []string{
+			testFamilyEmoji + " " + testFamilyEmoji, testFamilyEmoji + " " + testFamilyEmoji,
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			parts := splitText(tc.text, tc.limit)
+			assert.Equal(t, tc.expected, parts)
+			for _, part := range parts {
+				assert.LessOrEqual(t, uniseg.GraphemeClusterCount(part), tc.limit)
+			}
+		})
+	}
+}
+
+func TestGraphemePrefix(t *testing.T) {
+	assert.Equal(t, len(testFamilyEmoji), graphemePrefix(testFamilyEmoji+"abc", 1))
+	assert.Equal(t, len(testCombiningE)+1, graphemePrefix(testCombiningE+"ab", 2))
+	assert.Equal(t, 3, graphemePrefix("abc", 10))
+}
+
+// makeTestWords returns count words of 99 characters separated by spaces, so that exactly 10 words fit
+// in a single message.
+func makeTestWords(count int) string {
+	words := make([]string, count)
+	for i := range words {
+		words[i] = strings.Repeat("a", 99)
+	}
+	return strings.Join(words, " ")
+}
+
+func TestMakeMessageInputs(t *testing.T) {
+	b := &BlueskyClient{Main: &BlueskyConnector{Config: Config{SplitLongMessages: true}}}
+	testCases := []struct {
+		name          string
+		text          string
+		expectedParts int
+	}{
+		{"Single", "hello", 1},
+		{"MaxParts", makeTestWords(maxMessageSplitParts * 10), maxMessageSplitParts},
+		{"TooManyParts", makeTestWords(maxMessageSplitParts*10 + 1), 0},
+		// If the early paragraph break was used, the message would need 11 parts
+		{"EarlyBreakFits", "hi\n\n" + makeTestWords(95), maxMessageSplitParts},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inputs, err := b.makeMessageInputs(tc.text, nil)
+			if tc.expectedParts == 0 {
+				assert.Equal(t, errMessageTooLong, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, inputs, tc.expectedParts)
+			for _, input := range inputs {
+				assert.LessOrEqual(t, uniseg.GraphemeClusterCount(input.Text), maxMessageGraphemes)
+			}
+		})
+	}
+}
+
+func TestMakeMessageInputs_SplittingDisabled(t *testing.T) {
+	b := &BlueskyClient{Main: &BlueskyConnector{Config: Config{SplitLongMessages: false}}}
+	_, err := b.makeMessageInputs(makeTestWords(11), nil)
+	assert.Equal(t, errMessageTooLong, err)
+}